@@ -0,0 +1,144 @@
+package esphomehomekit
+
+import (
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+// binarySensorTypes maps esphome binary sensor device classes to homekit service types
+var binarySensorTypes = map[string]string{
+	"motion":          "motion",
+	"occupancy":       "occupancy",
+	"presence":        "occupancy",
+	"door":            "contact",
+	"garage_door":     "contact",
+	"window":          "contact",
+	"opening":         "contact",
+	"moisture":        "leak",
+	"smoke":           "smoke",
+	"gas":             "carbon_monoxide",
+	"carbon_monoxide": "carbon_monoxide",
+}
+
+func (d *device) createBinarySensorService(e *Entity) (sv *service.S, err error) {
+
+	typ := d.entityConfig(e).Type
+	if typ == "" {
+		if info, ok := e.Info.(*api.ListEntitiesBinarySensorResponse); ok {
+			typ = binarySensorTypes[info.DeviceClass]
+		}
+	}
+
+	switch typ {
+	case "programmable_switch":
+		return d.createProgrammableSwitchService(e)
+	case "doorbell":
+		return d.createDoorbellService(e)
+	case "motion":
+		return d.createMotionSensorService(e)
+	case "occupancy":
+		k := service.NewOccupancySensor()
+		return d.createDetectorService(e, k.S, k.OccupancyDetected.Int,
+			characteristic.OccupancyDetectedOccupancyDetected, characteristic.OccupancyDetectedOccupancyNotDetected)
+	case "leak":
+		k := service.NewLeakSensor()
+		return d.createDetectorService(e, k.S, k.LeakDetected.Int,
+			characteristic.LeakDetectedLeakDetected, characteristic.LeakDetectedLeakNotDetected)
+	case "smoke":
+		k := service.NewSmokeSensor()
+		return d.createDetectorService(e, k.S, k.SmokeDetected.Int,
+			characteristic.SmokeDetectedSmokeDetected, characteristic.SmokeDetectedSmokeNotDetected)
+	case "carbon_monoxide":
+		k := service.NewCarbonMonoxideSensor()
+		return d.createDetectorService(e, k.S, k.CarbonMonoxideDetected.Int,
+			characteristic.CarbonMonoxideDetectedCOLevelsAbnormal, characteristic.CarbonMonoxideDetectedCOLevelsNormal)
+	}
+
+	// contact sensor is used also for binary sensors without known device class,
+	// (esphome "on" is reported as open)
+	k := service.NewContactSensor()
+	return d.createDetectorService(e, k.S, k.ContactSensorState.Int,
+		characteristic.ContactSensorStateContactNotDetected, characteristic.ContactSensorStateContactDetected)
+}
+
+// createDetectorService maps binary sensor state to an integer characteristic of the sensor service
+func (d *device) createDetectorService(e *Entity, k *service.S, c *characteristic.Int, on, off int) (sv *service.S, err error) {
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	c.SetValue(off)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.BinarySensorStateResponse)
+		if ok {
+			if msg.State {
+				c.SetValue(on)
+			} else {
+				c.SetValue(off)
+			}
+		} else {
+			d.log.Errorf("unexpected state for binary sensor : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	// nothing here, as homekit can not change sensor state
+	sv = k
+	return
+}
+
+func (d *device) createMotionSensorService(e *Entity) (sv *service.S, err error) {
+
+	k := service.NewMotionSensor()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.BinarySensorStateResponse)
+		if ok {
+			k.MotionDetected.SetValue(msg.State)
+		} else {
+			d.log.Errorf("unexpected state for binary sensor : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	// nothing here, as homekit can not change sensor state
+	sv = k.S
+	return
+}
+
+// createDoorbellService rings the doorbell (single press) when binary sensor turns on
+func (d *device) createDoorbellService(e *Entity) (sv *service.S, err error) {
+
+	k := service.NewDoorbell()
+	k.ProgrammableSwitchEvent.MaxVal = characteristic.ProgrammableSwitchEventSinglePress
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.BinarySensorStateResponse)
+		if ok {
+			if msg.State {
+				k.ProgrammableSwitchEvent.SetValue(characteristic.ProgrammableSwitchEventSinglePress)
+			}
+		} else {
+			d.log.Errorf("unexpected state for binary sensor : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	// nothing here, as homekit can not trigger this event
+	sv = k.S
+	return
+}
@@ -0,0 +1,41 @@
+package esphomehomekit
+
+import (
+	"time"
+
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+// default time after which a button switch turns itself off
+const buttonResetDelay = time.Second
+
+func (d *device) createButtonService(e *Entity) (sv *service.S, err error) {
+
+	cfg := d.entityConfig(e)
+
+	info, ok := e.Info.(*api.ListEntitiesButtonResponse)
+	if ok && info.EntityCategory != api.EntityCategory_ENTITY_CATEGORY_NONE && !cfg.Include {
+		// config and diagnostic buttons (restart, ...) are published only on request
+		d.log.Debugf("skipping %s button %s", info.EntityCategory, e.ID)
+		return
+	}
+
+	delay := cfg.ResetDelay
+	if delay <= 0 {
+		delay = buttonResetDelay
+	}
+
+	// homekit -> esphome
+	k := d.newMomentarySwitch(e.Name, delay, func() error {
+		return d.Send(&api.ButtonCommandRequest{
+			Key: e.Key,
+		})
+	})
+
+	// esphome -> homekit
+	// nothing here, buttons have no state
+
+	sv = k.S
+	return
+}
@@ -0,0 +1,214 @@
+package esphomehomekit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/rtp"
+	"github.com/brutella/hap/service"
+	"github.com/brutella/hap/tlv8"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+// default time for which a snapshot is served from cache
+const snapshotMaxAge = 10 * time.Second
+
+// time to wait for esphome camera image
+const snapshotTimeout = 10 * time.Second
+
+// camera reassembles esphome camera images and caches the last one
+type camera struct {
+	key     uint32
+	maxAge  time.Duration
+	mu      sync.Mutex
+	buffer  []byte
+	image   []byte
+	takenAt time.Time
+	waiting []chan []byte
+}
+
+// receive adds image chunk, when the image is done it is passed to all waiting requests
+func (c *camera) receive(msg *api.CameraImageResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.buffer = append(c.buffer, msg.Data...)
+	if !msg.Done {
+		return
+	}
+
+	c.image = c.buffer
+	c.takenAt = time.Now()
+	c.buffer = nil
+
+	for _, w := range c.waiting {
+		w <- c.image
+	}
+	c.waiting = nil
+}
+
+// reset drops partially received image and fails all waiting requests,
+// it is called when esphome client is replaced as the image would never be finished
+func (c *camera) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.buffer = nil
+	c.failWaiting()
+}
+
+// failWaiting closes channels of all waiting requests without an image
+func (c *camera) failWaiting() {
+	for _, w := range c.waiting {
+		close(w)
+	}
+	c.waiting = nil
+}
+
+// stopWaiting removes request from waiting ones
+func (c *camera) stopWaiting(w chan []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, x := range c.waiting {
+		if x == w {
+			c.waiting = append(c.waiting[:i], c.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// snapshot returns cached image if it is not older than max age, otherwise requests a new one
+func (d *device) snapshot() ([]byte, error) {
+	c := d.currentCamera()
+	if c == nil {
+		return nil, errors.New("device has no camera")
+	}
+
+	c.mu.Lock()
+	if c.image != nil && time.Since(c.takenAt) < c.maxAge {
+		image := c.image
+		c.mu.Unlock()
+		return image, nil
+	}
+
+	w := make(chan []byte, 1)
+	c.waiting = append(c.waiting, w)
+	if len(c.waiting) == 1 {
+		// image is requested only once for all waiting requests
+		err := d.Send(&api.CameraImageRequest{Single: true})
+		if err != nil {
+			c.failWaiting()
+			c.mu.Unlock()
+			return nil, err
+		}
+	}
+	c.mu.Unlock()
+
+	select {
+	case image, ok := <-w:
+		if !ok {
+			return nil, errors.New("camera image request failed")
+		}
+		return image, nil
+	case <-time.After(snapshotTimeout):
+		c.stopWaiting(w)
+		return nil, errors.New("timeout waiting for camera image")
+	}
+}
+
+func (d *device) createCameraService(e *Entity) (sv *service.S, err error) {
+
+	maxAge := d.entityConfig(e).SnapshotMaxAge
+	if maxAge <= 0 {
+		maxAge = snapshotMaxAge
+	}
+
+	d.mu.Lock()
+	if d.camera != nil {
+		d.mu.Unlock()
+		d.warnOnce(e, d.log, "only one camera per device is supported, skipping %s", e.ID)
+		return
+	}
+	d.camera = &camera{
+		key:    e.Key,
+		maxAge: maxAge,
+	}
+	d.mu.Unlock()
+
+	k := service.NewCameraRTPStreamManagement()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	// live streaming is not supported, stream configuration is required to show snapshots
+	video, err := tlv8.Marshal(rtp.DefaultVideoStreamConfiguration())
+	if err != nil {
+		return
+	}
+	k.SupportedVideoStreamConfiguration.SetValue(video)
+
+	audio, err := tlv8.Marshal(rtp.DefaultAudioStreamConfiguration())
+	if err != nil {
+		return
+	}
+	k.SupportedAudioStreamConfiguration.SetValue(audio)
+
+	conf, err := tlv8.Marshal(rtp.NewConfiguration(rtp.CryptoSuite_AES_CM_128_HMAC_SHA1_80))
+	if err != nil {
+		return
+	}
+	k.SupportedRTPConfiguration.SetValue(conf)
+
+	status, err := tlv8.Marshal(rtp.StreamingStatus{Status: rtp.StreamingStatusUnavailable})
+	if err != nil {
+		return
+	}
+	k.StreamingStatus.SetValue(status)
+
+	sv = k.S
+	return
+}
+
+// snapshotHandler serves camera snapshots requested by homekit
+func (s *svc) snapshotHandler(server *hap.Server) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if !server.IsAuthorized(req) {
+			hap.JsonError(res, hap.JsonStatusInsufficientPrivileges)
+			return
+		}
+
+		var r struct {
+			Aid  uint64 `json:"aid"`
+			Type string `json:"resource-type"`
+		}
+		err := json.NewDecoder(req.Body).Decode(&r)
+		if err != nil || r.Type != "image" {
+			hap.JsonError(res, hap.JsonStatusInvalidValueInRequest)
+			return
+		}
+
+		d := s.deviceByAccessoryID(r.Aid)
+		if d == nil {
+			hap.JsonError(res, hap.JsonStatusResourceDoesNotExist)
+			return
+		}
+
+		image, err := d.snapshot()
+		if err != nil {
+			d.log.WithError(err).Error("unable to get snapshot")
+			hap.JsonError(res, hap.JsonStatusResourceBusy)
+			return
+		}
+
+		res.Header().Set("Content-Type", "image/jpeg")
+		wr := hap.NewChunkedWriter(res, 2048)
+		wr.Write(image)
+	}
+}
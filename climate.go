@@ -0,0 +1,568 @@
+package esphomehomekit
+
+import (
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+type climateModes map[api.ClimateMode]bool
+
+func newClimateModes(info *api.ListEntitiesClimateResponse) climateModes {
+	modes := make(climateModes)
+	for _, m := range info.SupportedModes {
+		modes[m] = true
+	}
+	return modes
+}
+
+// autoMode returns esphome mode used for homekit auto mode
+func (m climateModes) autoMode() api.ClimateMode {
+	if m[api.ClimateMode_CLIMATE_MODE_HEAT_COOL] {
+		return api.ClimateMode_CLIMATE_MODE_HEAT_COOL
+	}
+	return api.ClimateMode_CLIMATE_MODE_AUTO
+}
+
+func (m climateModes) supportsAuto() bool {
+	return m[api.ClimateMode_CLIMATE_MODE_HEAT_COOL] || m[api.ClimateMode_CLIMATE_MODE_AUTO]
+}
+
+// isHeatPump returns true for devices that look like air conditioner or heat pump
+func (m climateModes) isHeatPump() bool {
+	return m[api.ClimateMode_CLIMATE_MODE_FAN_ONLY] || m[api.ClimateMode_CLIMATE_MODE_DRY]
+}
+
+// setTemperatureBounds applies esphome visual limits to the characteristic
+func setTemperatureBounds(c *characteristic.Float, info *api.ListEntitiesClimateResponse) {
+	if info.VisualMaxTemperature > info.VisualMinTemperature {
+		c.SetMinValue(float64(info.VisualMinTemperature))
+		c.SetMaxValue(float64(info.VisualMaxTemperature))
+	}
+	if info.VisualTemperatureStep > 0 {
+		c.SetStepValue(float64(info.VisualTemperatureStep))
+	}
+}
+
+func (d *device) createClimateService(e *Entity) (sv *service.S, err error) {
+
+	info, ok := e.Info.(*api.ListEntitiesClimateResponse)
+	if !ok {
+		return
+	}
+
+	switch d.entityConfig(e).Type {
+	case "thermostat":
+		sv, err = d.createThermostatService(e, info)
+	case "heater_cooler":
+		sv, err = d.createHeaterCoolerService(e, info)
+	default:
+		if newClimateModes(info).isHeatPump() {
+			sv, err = d.createHeaterCoolerService(e, info)
+		} else {
+			sv, err = d.createThermostatService(e, info)
+		}
+	}
+	if err != nil || sv == nil {
+		return
+	}
+
+	if fan := d.createClimateFanService(e, info); fan != nil {
+		sv.AddS(fan)
+	}
+	return
+}
+
+func (d *device) createThermostatService(e *Entity, info *api.ListEntitiesClimateResponse) (sv *service.S, err error) {
+
+	modes := newClimateModes(info)
+
+	k := service.NewThermostat()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	validModes := []int{characteristic.TargetHeatingCoolingStateOff}
+	if modes[api.ClimateMode_CLIMATE_MODE_HEAT] {
+		validModes = append(validModes, characteristic.TargetHeatingCoolingStateHeat)
+	}
+	if modes[api.ClimateMode_CLIMATE_MODE_COOL] {
+		validModes = append(validModes, characteristic.TargetHeatingCoolingStateCool)
+	}
+	if modes.supportsAuto() {
+		validModes = append(validModes, characteristic.TargetHeatingCoolingStateAuto)
+	}
+	k.TargetHeatingCoolingState.ValidVals = validModes
+
+	setTemperatureBounds(k.TargetTemperature.Float, info)
+
+	heating := characteristic.NewHeatingThresholdTemperature()
+	cooling := characteristic.NewCoolingThresholdTemperature()
+	if info.SupportsTwoPointTargetTemperature {
+		setTemperatureBounds(heating.Float, info)
+		setTemperatureBounds(cooling.Float, info)
+		k.AddC(heating.C)
+		k.AddC(cooling.C)
+	}
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.ClimateStateResponse)
+		if ok {
+			if info.SupportsCurrentTemperature {
+				k.CurrentTemperature.SetValue(float64(msg.CurrentTemperature))
+			}
+
+			switch msg.Mode {
+			case api.ClimateMode_CLIMATE_MODE_HEAT:
+				k.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateHeat)
+			case api.ClimateMode_CLIMATE_MODE_COOL:
+				k.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateCool)
+			case api.ClimateMode_CLIMATE_MODE_HEAT_COOL, api.ClimateMode_CLIMATE_MODE_AUTO:
+				k.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateAuto)
+			default:
+				// fan only and dry have no equivalent in homekit
+				k.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateOff)
+			}
+
+			current := characteristic.CurrentHeatingCoolingStateOff
+			if info.SupportsAction {
+				switch msg.Action {
+				case api.ClimateAction_CLIMATE_ACTION_HEATING:
+					current = characteristic.CurrentHeatingCoolingStateHeat
+				case api.ClimateAction_CLIMATE_ACTION_COOLING:
+					current = characteristic.CurrentHeatingCoolingStateCool
+				}
+			} else {
+				switch msg.Mode {
+				case api.ClimateMode_CLIMATE_MODE_HEAT:
+					current = characteristic.CurrentHeatingCoolingStateHeat
+				case api.ClimateMode_CLIMATE_MODE_COOL:
+					current = characteristic.CurrentHeatingCoolingStateCool
+				}
+			}
+			k.CurrentHeatingCoolingState.SetValue(current)
+
+			if info.SupportsTwoPointTargetTemperature {
+				heating.SetValue(float64(msg.TargetTemperatureLow))
+				cooling.SetValue(float64(msg.TargetTemperatureHigh))
+
+				switch msg.Mode {
+				case api.ClimateMode_CLIMATE_MODE_HEAT:
+					k.TargetTemperature.SetValue(float64(msg.TargetTemperatureLow))
+				case api.ClimateMode_CLIMATE_MODE_COOL:
+					k.TargetTemperature.SetValue(float64(msg.TargetTemperatureHigh))
+				default:
+					k.TargetTemperature.SetValue(float64(msg.TargetTemperatureLow+msg.TargetTemperatureHigh) / 2)
+				}
+			} else {
+				k.TargetTemperature.SetValue(float64(msg.TargetTemperature))
+			}
+		} else {
+			d.log.Errorf("unexpected state for climate : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	k.TargetHeatingCoolingState.OnSetRemoteValue(func(v int) error {
+		mode := api.ClimateMode_CLIMATE_MODE_OFF
+		switch v {
+		case characteristic.TargetHeatingCoolingStateHeat:
+			mode = api.ClimateMode_CLIMATE_MODE_HEAT
+		case characteristic.TargetHeatingCoolingStateCool:
+			mode = api.ClimateMode_CLIMATE_MODE_COOL
+		case characteristic.TargetHeatingCoolingStateAuto:
+			mode = modes.autoMode()
+		}
+
+		return d.Send(&api.ClimateCommandRequest{
+			Key:     e.Key,
+			HasMode: true,
+			Mode:    mode,
+		})
+	})
+
+	k.TargetTemperature.OnSetRemoteValue(func(v float64) error {
+		if !info.SupportsTwoPointTargetTemperature {
+			return d.Send(&api.ClimateCommandRequest{
+				Key:                  e.Key,
+				HasTargetTemperature: true,
+				TargetTemperature:    float32(v),
+			})
+		}
+
+		// two point devices use low target for heating and high target for cooling
+		switch k.TargetHeatingCoolingState.Value() {
+		case characteristic.TargetHeatingCoolingStateHeat:
+			return d.Send(&api.ClimateCommandRequest{
+				Key:                     e.Key,
+				HasTargetTemperatureLow: true,
+				TargetTemperatureLow:    float32(v),
+			})
+		case characteristic.TargetHeatingCoolingStateCool:
+			return d.Send(&api.ClimateCommandRequest{
+				Key:                      e.Key,
+				HasTargetTemperatureHigh: true,
+				TargetTemperatureHigh:    float32(v),
+			})
+		}
+		// in auto mode homekit sets thresholds
+		return nil
+	})
+
+	heating.OnSetRemoteValue(func(v float64) error {
+		return d.Send(&api.ClimateCommandRequest{
+			Key:                     e.Key,
+			HasTargetTemperatureLow: true,
+			TargetTemperatureLow:    float32(v),
+		})
+	})
+
+	cooling.OnSetRemoteValue(func(v float64) error {
+		return d.Send(&api.ClimateCommandRequest{
+			Key:                      e.Key,
+			HasTargetTemperatureHigh: true,
+			TargetTemperatureHigh:    float32(v),
+		})
+	})
+
+	sv = k.S
+	return
+}
+
+func (d *device) createHeaterCoolerService(e *Entity, info *api.ListEntitiesClimateResponse) (sv *service.S, err error) {
+
+	modes := newClimateModes(info)
+
+	k := service.NewHeaterCooler()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	var validModes []int
+	if modes.supportsAuto() {
+		validModes = append(validModes, characteristic.TargetHeaterCoolerStateAuto)
+	}
+	if modes[api.ClimateMode_CLIMATE_MODE_HEAT] {
+		validModes = append(validModes, characteristic.TargetHeaterCoolerStateHeat)
+	}
+	if modes[api.ClimateMode_CLIMATE_MODE_COOL] {
+		validModes = append(validModes, characteristic.TargetHeaterCoolerStateCool)
+	}
+	k.TargetHeaterCoolerState.ValidVals = validModes
+	if len(validModes) > 0 {
+		k.TargetHeaterCoolerState.SetValue(validModes[0])
+	}
+
+	heating := characteristic.NewHeatingThresholdTemperature()
+	setTemperatureBounds(heating.Float, info)
+	cooling := characteristic.NewCoolingThresholdTemperature()
+	setTemperatureBounds(cooling.Float, info)
+	if modes[api.ClimateMode_CLIMATE_MODE_HEAT] || modes.supportsAuto() {
+		k.AddC(heating.C)
+	}
+	if modes[api.ClimateMode_CLIMATE_MODE_COOL] || modes.supportsAuto() {
+		k.AddC(cooling.C)
+	}
+
+	// mode to restore when homekit activates the device
+	lastMode := api.ClimateMode_CLIMATE_MODE_OFF
+	if len(validModes) > 0 {
+		lastMode = heaterCoolerMode(validModes[0], modes)
+	}
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.ClimateStateResponse)
+		if ok {
+			if info.SupportsCurrentTemperature {
+				k.CurrentTemperature.SetValue(float64(msg.CurrentTemperature))
+			}
+
+			if msg.Mode == api.ClimateMode_CLIMATE_MODE_OFF {
+				k.Active.SetValue(characteristic.ActiveInactive)
+			} else {
+				k.Active.SetValue(characteristic.ActiveActive)
+				lastMode = msg.Mode
+			}
+
+			switch msg.Mode {
+			case api.ClimateMode_CLIMATE_MODE_HEAT:
+				k.TargetHeaterCoolerState.SetValue(characteristic.TargetHeaterCoolerStateHeat)
+			case api.ClimateMode_CLIMATE_MODE_COOL:
+				k.TargetHeaterCoolerState.SetValue(characteristic.TargetHeaterCoolerStateCool)
+			case api.ClimateMode_CLIMATE_MODE_HEAT_COOL, api.ClimateMode_CLIMATE_MODE_AUTO:
+				k.TargetHeaterCoolerState.SetValue(characteristic.TargetHeaterCoolerStateAuto)
+			}
+
+			current := characteristic.CurrentHeaterCoolerStateIdle
+			if msg.Mode == api.ClimateMode_CLIMATE_MODE_OFF {
+				current = characteristic.CurrentHeaterCoolerStateInactive
+			} else if info.SupportsAction {
+				switch msg.Action {
+				case api.ClimateAction_CLIMATE_ACTION_HEATING:
+					current = characteristic.CurrentHeaterCoolerStateHeating
+				case api.ClimateAction_CLIMATE_ACTION_COOLING:
+					current = characteristic.CurrentHeaterCoolerStateCooling
+				case api.ClimateAction_CLIMATE_ACTION_OFF:
+					current = characteristic.CurrentHeaterCoolerStateInactive
+				}
+			}
+			k.CurrentHeaterCoolerState.SetValue(current)
+
+			if info.SupportsTwoPointTargetTemperature {
+				heating.SetValue(float64(msg.TargetTemperatureLow))
+				cooling.SetValue(float64(msg.TargetTemperatureHigh))
+			} else {
+				heating.SetValue(float64(msg.TargetTemperature))
+				cooling.SetValue(float64(msg.TargetTemperature))
+			}
+		} else {
+			d.log.Errorf("unexpected state for climate : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	k.Active.OnSetRemoteValue(func(v int) error {
+		mode := api.ClimateMode_CLIMATE_MODE_OFF
+		if v == characteristic.ActiveActive {
+			mode = lastMode
+		}
+
+		return d.Send(&api.ClimateCommandRequest{
+			Key:     e.Key,
+			HasMode: true,
+			Mode:    mode,
+		})
+	})
+
+	k.TargetHeaterCoolerState.OnSetRemoteValue(func(v int) error {
+		return d.Send(&api.ClimateCommandRequest{
+			Key:     e.Key,
+			HasMode: true,
+			Mode:    heaterCoolerMode(v, modes),
+		})
+	})
+
+	heating.OnSetRemoteValue(func(v float64) error {
+		if !info.SupportsTwoPointTargetTemperature {
+			return d.Send(&api.ClimateCommandRequest{
+				Key:                  e.Key,
+				HasTargetTemperature: true,
+				TargetTemperature:    float32(v),
+			})
+		}
+		return d.Send(&api.ClimateCommandRequest{
+			Key:                     e.Key,
+			HasTargetTemperatureLow: true,
+			TargetTemperatureLow:    float32(v),
+		})
+	})
+
+	cooling.OnSetRemoteValue(func(v float64) error {
+		if !info.SupportsTwoPointTargetTemperature {
+			return d.Send(&api.ClimateCommandRequest{
+				Key:                  e.Key,
+				HasTargetTemperature: true,
+				TargetTemperature:    float32(v),
+			})
+		}
+		return d.Send(&api.ClimateCommandRequest{
+			Key:                      e.Key,
+			HasTargetTemperatureHigh: true,
+			TargetTemperatureHigh:    float32(v),
+		})
+	})
+
+	sv = k.S
+	return
+}
+
+// heaterCoolerMode converts homekit heater cooler target state to esphome mode
+func heaterCoolerMode(v int, modes climateModes) api.ClimateMode {
+	switch v {
+	case characteristic.TargetHeaterCoolerStateHeat:
+		return api.ClimateMode_CLIMATE_MODE_HEAT
+	case characteristic.TargetHeaterCoolerStateCool:
+		return api.ClimateMode_CLIMATE_MODE_COOL
+	}
+	return modes.autoMode()
+}
+
+// climateFanSpeeds are esphome fan modes that represent fan speed, from slowest to fastest
+var climateFanSpeeds = []api.ClimateFanMode{
+	api.ClimateFanMode_CLIMATE_FAN_LOW,
+	api.ClimateFanMode_CLIMATE_FAN_MIDDLE,
+	api.ClimateFanMode_CLIMATE_FAN_MEDIUM,
+	api.ClimateFanMode_CLIMATE_FAN_HIGH,
+}
+
+// swingModeEnabled returns the esphome swing mode used when homekit enables swing
+func swingModeEnabled(info *api.ListEntitiesClimateResponse) (api.ClimateSwingMode, bool) {
+	supported := make(map[api.ClimateSwingMode]bool)
+	for _, m := range info.SupportedSwingModes {
+		supported[m] = true
+	}
+	for _, m := range []api.ClimateSwingMode{
+		api.ClimateSwingMode_CLIMATE_SWING_BOTH,
+		api.ClimateSwingMode_CLIMATE_SWING_VERTICAL,
+		api.ClimateSwingMode_CLIMATE_SWING_HORIZONTAL,
+	} {
+		if supported[m] {
+			return m, true
+		}
+	}
+	return api.ClimateSwingMode_CLIMATE_SWING_OFF, false
+}
+
+// createClimateFanService creates fan service linked to the climate service,
+// controlling esphome fan mode and swing mode. Returns nil if the climate
+// supports neither.
+func (d *device) createClimateFanService(e *Entity, info *api.ListEntitiesClimateResponse) *service.S {
+
+	fanModes := make(map[api.ClimateFanMode]bool)
+	for _, m := range info.SupportedFanModes {
+		fanModes[m] = true
+	}
+
+	var speeds []api.ClimateFanMode
+	for _, m := range climateFanSpeeds {
+		if fanModes[m] {
+			speeds = append(speeds, m)
+		}
+	}
+
+	swingOn, supportsSwing := swingModeEnabled(info)
+	supportsAuto := fanModes[api.ClimateFanMode_CLIMATE_FAN_AUTO]
+
+	if len(speeds) == 0 && !supportsSwing && !supportsAuto {
+		return nil
+	}
+
+	k := service.NewFanV2()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name + " Fan")
+	k.AddC(name.C)
+
+	speed := characteristic.NewRotationSpeed()
+	if len(speeds) > 0 {
+		speed.SetStepValue(fanSpeedPercentage(1, len(speeds)))
+		k.AddC(speed.C)
+	}
+
+	swing := characteristic.NewSwingMode()
+	if supportsSwing {
+		k.AddC(swing.C)
+	}
+
+	targetState := characteristic.NewTargetFanState()
+	if supportsAuto {
+		k.AddC(targetState.C)
+	}
+
+	// fan mode to restore when homekit turns the fan on
+	onMode := api.ClimateFanMode_CLIMATE_FAN_ON
+	if supportsAuto {
+		onMode = api.ClimateFanMode_CLIMATE_FAN_AUTO
+	} else if len(speeds) > 0 {
+		onMode = speeds[0]
+	}
+
+	// esphome -> homekit
+	e.watch(func(newState interface{}) {
+		msg, ok := newState.(*api.ClimateStateResponse)
+		if !ok {
+			return
+		}
+
+		if msg.FanMode == api.ClimateFanMode_CLIMATE_FAN_OFF || msg.Mode == api.ClimateMode_CLIMATE_MODE_OFF {
+			k.Active.SetValue(characteristic.ActiveInactive)
+		} else {
+			k.Active.SetValue(characteristic.ActiveActive)
+		}
+
+		if msg.FanMode == api.ClimateFanMode_CLIMATE_FAN_AUTO {
+			targetState.SetValue(characteristic.TargetFanStateAuto)
+		} else {
+			targetState.SetValue(characteristic.TargetFanStateManual)
+		}
+
+		for i, m := range speeds {
+			if m == msg.FanMode {
+				speed.SetValue(fanSpeedPercentage(i+1, len(speeds)))
+				onMode = m
+			}
+		}
+
+		if msg.SwingMode == api.ClimateSwingMode_CLIMATE_SWING_OFF {
+			swing.SetValue(characteristic.SwingModeSwingDisabled)
+		} else {
+			swing.SetValue(characteristic.SwingModeSwingEnabled)
+		}
+	})
+
+	// homekit -> esphome
+	k.Active.OnSetRemoteValue(func(v int) error {
+		mode := onMode
+		if v == characteristic.ActiveInactive {
+			if !fanModes[api.ClimateFanMode_CLIMATE_FAN_OFF] {
+				// fan can not be turned off separately
+				return nil
+			}
+			mode = api.ClimateFanMode_CLIMATE_FAN_OFF
+		}
+
+		return d.Send(&api.ClimateCommandRequest{
+			Key:        e.Key,
+			HasFanMode: true,
+			FanMode:    mode,
+		})
+	})
+
+	speed.OnSetRemoteValue(func(v float64) error {
+		if v <= 0 {
+			// homekit turns the fan off using Active
+			return nil
+		}
+
+		return d.Send(&api.ClimateCommandRequest{
+			Key:        e.Key,
+			HasFanMode: true,
+			FanMode:    speeds[fanSpeedLevel(v, len(speeds))-1],
+		})
+	})
+
+	targetState.OnSetRemoteValue(func(v int) error {
+		mode := api.ClimateFanMode_CLIMATE_FAN_AUTO
+		if v == characteristic.TargetFanStateManual {
+			mode = api.ClimateFanMode_CLIMATE_FAN_ON
+			if len(speeds) > 0 {
+				mode = speeds[len(speeds)-1]
+			}
+		}
+
+		return d.Send(&api.ClimateCommandRequest{
+			Key:        e.Key,
+			HasFanMode: true,
+			FanMode:    mode,
+		})
+	})
+
+	swing.OnSetRemoteValue(func(v int) error {
+		mode := api.ClimateSwingMode_CLIMATE_SWING_OFF
+		if v == characteristic.SwingModeSwingEnabled {
+			mode = swingOn
+		}
+
+		return d.Send(&api.ClimateCommandRequest{
+			Key:          e.Key,
+			HasSwingMode: true,
+			SwingMode:    mode,
+		})
+	})
+
+	return k.S
+}
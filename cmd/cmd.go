@@ -1,11 +1,90 @@
-package main
-
-import (
-	esphomehomekit "github.com/mligor/esphome-homekit"
-)
-
-func main() {
-
-	svc := esphomehomekit.New()
-	svc.Start()
-}
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/mitchellh/mapstructure"
+	esphomehomekit "github.com/mligor/esphome-homekit"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// strictDecoding reports unknown config keys as errors
+func strictDecoding(c *mapstructure.DecoderConfig) {
+	c.ErrorUnused = true
+}
+
+// loadOptions reads bridge options from the config
+func loadOptions() (opts esphomehomekit.Options, err error) {
+
+	opts.Name = viper.GetString("name")
+	opts.Address = viper.GetString("address")
+	opts.Password = viper.GetString("password")
+	opts.Pin = viper.GetString("homekit.pin")
+	opts.StorageDir = viper.GetString("homekit.storage_dir")
+
+	err = viper.UnmarshalKey("entities", &opts.Entities, strictDecoding)
+	if err != nil {
+		return
+	}
+
+	err = viper.UnmarshalKey("devices", &opts.Devices, strictDecoding)
+	if err != nil {
+		return
+	}
+
+	err = viper.UnmarshalKey("reconnect", &opts.Reconnect, strictDecoding)
+	return
+}
+
+func main() {
+
+	viper.SetDefault("log_level", "warning")
+	viper.SetConfigName("config")
+	viper.AddConfigPath(".")
+	viper.AutomaticEnv()
+	pflag.String("log_level", "warning", "Log level")
+
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	pflag.Parse()
+	viper.BindPFlags(pflag.CommandLine)
+
+	err := viper.ReadInConfig()
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to read config")
+	}
+
+	customFormatter := new(logrus.TextFormatter)
+	customFormatter.TimestampFormat = "2006-01-02 15:04:05"
+	customFormatter.FullTimestamp = true
+	customFormatter.ForceColors = true
+	logrus.SetFormatter(customFormatter)
+
+	logLevel, err := logrus.ParseLevel(viper.GetString("log_level"))
+	if err != nil {
+		logrus.WithError(err).Errorf("wrong log_level text : %s", viper.GetString("log_level"))
+	}
+	logrus.WithField("log_level", logLevel).Print("Log level set")
+	logrus.SetLevel(logLevel)
+
+	opts, err := loadOptions()
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid config")
+	}
+	opts.Logger = logrus.StandardLogger()
+
+	// Stop the bridge on interrupts and SIGTERM signals.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	svc := esphomehomekit.New(opts)
+	err = svc.Run(ctx)
+	if err != nil {
+		logrus.WithError(err).Fatal("bridge stopped")
+	}
+}
@@ -0,0 +1,233 @@
+package esphomehomekit
+
+import (
+	"math"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+// coverPosition converts esphome position (0.0 closed - 1.0 open) to homekit percentage
+func coverPosition(msg *api.CoverStateResponse, supportsPosition bool) int {
+	if !supportsPosition {
+		// covers without position report only open/closed
+		if msg.LegacyState == api.LegacyCoverState_LEGACY_COVER_STATE_OPEN || msg.Position > 0 {
+			return 100
+		}
+		return 0
+	}
+	return int(math.Round(float64(msg.Position) * 100))
+}
+
+// coverPositionState converts esphome cover operation to homekit position state
+func coverPositionState(op api.CoverOperation) int {
+	switch op {
+	case api.CoverOperation_COVER_OPERATION_IS_OPENING:
+		return characteristic.PositionStateIncreasing
+	case api.CoverOperation_COVER_OPERATION_IS_CLOSING:
+		return characteristic.PositionStateDecreasing
+	}
+	return characteristic.PositionStateStopped
+}
+
+// coverOpenCloseRequest fully opens or closes the cover
+func coverOpenCloseRequest(key uint32, open bool) *api.CoverCommandRequest {
+	command := api.LegacyCoverCommand_LEGACY_COVER_COMMAND_CLOSE
+	if open {
+		command = api.LegacyCoverCommand_LEGACY_COVER_COMMAND_OPEN
+	}
+	return &api.CoverCommandRequest{
+		Key:              key,
+		HasLegacyCommand: true,
+		LegacyCommand:    command,
+	}
+}
+
+// tiltAngle converts esphome tilt (0.0 closed - 1.0 open) to homekit angle (-90° - 90°)
+func tiltAngle(tilt float32) int {
+	return int(math.Round(float64(tilt)*180)) - 90
+}
+
+func (d *device) createCoverService(e *Entity) (sv *service.S, err error) {
+
+	supportsPosition := false
+	supportsTilt := false
+	assumedState := false
+
+	info, ok := e.Info.(*api.ListEntitiesCoverResponse)
+	if ok {
+		switch info.DeviceClass {
+		case "garage", "gate":
+			return d.createGarageDoorService(e)
+		}
+
+		supportsPosition = info.SupportsPosition
+		supportsTilt = info.SupportsTilt
+		assumedState = info.AssumedState
+	}
+
+	k := service.NewWindowCovering()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	if !supportsPosition {
+		// only fully open or fully closed is possible
+		k.TargetPosition.SetStepValue(100)
+	}
+
+	hold := characteristic.NewHoldPosition()
+	k.AddC(hold.C)
+
+	currentTilt := characteristic.NewCurrentHorizontalTiltAngle()
+	targetTilt := characteristic.NewTargetHorizontalTiltAngle()
+	if supportsTilt {
+		k.AddC(currentTilt.C)
+		k.AddC(targetTilt.C)
+	}
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.CoverStateResponse)
+		if ok {
+			position := coverPosition(msg, supportsPosition)
+			positionState := coverPositionState(msg.CurrentOperation)
+
+			k.CurrentPosition.SetValue(position)
+			k.PositionState.SetValue(positionState)
+			if positionState == characteristic.PositionStateStopped {
+				k.TargetPosition.SetValue(position)
+			}
+
+			if supportsTilt {
+				currentTilt.SetValue(tiltAngle(msg.Tilt))
+				if positionState == characteristic.PositionStateStopped {
+					targetTilt.SetValue(tiltAngle(msg.Tilt))
+				}
+			}
+		} else {
+			d.log.Errorf("unexpected state for cover : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	k.TargetPosition.OnSetRemoteValue(func(v int) error {
+		if !supportsPosition {
+			err := d.Send(coverOpenCloseRequest(e.Key, v >= 50))
+			if err == nil && assumedState {
+				// device does not know its real state, trust the last command
+				k.CurrentPosition.SetValue(v)
+			}
+			return err
+		}
+
+		return d.Send(&api.CoverCommandRequest{
+			Key:         e.Key,
+			HasPosition: true,
+			Position:    float32(v) / 100.0,
+		})
+	})
+
+	targetTilt.OnSetRemoteValue(func(v int) error {
+		return d.Send(&api.CoverCommandRequest{
+			Key:     e.Key,
+			HasTilt: true,
+			Tilt:    float32(v+90) / 180.0,
+		})
+	})
+
+	hold.OnSetRemoteValue(func(v bool) error {
+		if !v {
+			return nil
+		}
+		return d.Send(&api.CoverCommandRequest{
+			Key:  e.Key,
+			Stop: true,
+		})
+	})
+	// hold position is write only, reset it so the next write is not ignored as the same value
+	hold.OnValueRemoteUpdate(func(v bool) {
+		hold.Val = false
+	})
+
+	sv = k.S
+	return
+}
+
+// doorState converts esphome cover state to homekit door state.
+// A door that is not moving and is neither fully open nor closed is reported as stopped.
+func doorState(msg *api.CoverStateResponse, supportsPosition bool) int {
+	switch msg.CurrentOperation {
+	case api.CoverOperation_COVER_OPERATION_IS_OPENING:
+		return characteristic.CurrentDoorStateOpening
+	case api.CoverOperation_COVER_OPERATION_IS_CLOSING:
+		return characteristic.CurrentDoorStateClosing
+	}
+
+	switch coverPosition(msg, supportsPosition) {
+	case 0:
+		return characteristic.CurrentDoorStateClosed
+	case 100:
+		return characteristic.CurrentDoorStateOpen
+	}
+	return characteristic.CurrentDoorStateStopped
+}
+
+func (d *device) createGarageDoorService(e *Entity) (sv *service.S, err error) {
+
+	supportsPosition := false
+
+	info, ok := e.Info.(*api.ListEntitiesCoverResponse)
+	if ok {
+		supportsPosition = info.SupportsPosition
+	}
+
+	k := service.NewGarageDoorOpener()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.CoverStateResponse)
+		if ok {
+			state := doorState(msg, supportsPosition)
+			k.CurrentDoorState.SetValue(state)
+
+			switch state {
+			case characteristic.CurrentDoorStateOpen, characteristic.CurrentDoorStateOpening:
+				k.TargetDoorState.SetValue(characteristic.TargetDoorStateOpen)
+			case characteristic.CurrentDoorStateClosed, characteristic.CurrentDoorStateClosing:
+				k.TargetDoorState.SetValue(characteristic.TargetDoorStateClosed)
+			}
+		} else {
+			d.log.Errorf("unexpected state for garage door : %+v", newState)
+		}
+	})
+
+	// obstruction is reported by optional binary sensor
+	if id := d.entityConfig(e).ObstructionSensor; id != "" {
+		sensor := d.currentEntities().byID(id)
+		if sensor == nil || sensor.Type != EntityTypeBinarySensor {
+			d.warnOnce(e, d.log, "obstruction sensor %s for %s not found", id, e.ID)
+		} else {
+			sensor.watch(func(newState interface{}) {
+				msg, ok := newState.(*api.BinarySensorStateResponse)
+				if ok {
+					k.ObstructionDetected.SetValue(msg.State)
+				}
+			})
+		}
+	}
+
+	// homekit -> esphome
+	k.TargetDoorState.OnSetRemoteValue(func(v int) error {
+		return d.Send(coverOpenCloseRequest(e.Key, v == characteristic.TargetDoorStateOpen))
+	})
+
+	sv = k.S
+	return
+}
@@ -0,0 +1,60 @@
+package esphomehomekit
+
+import (
+	"testing"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+func TestCoverPosition(t *testing.T) {
+	tests := []struct {
+		name             string
+		msg              *api.CoverStateResponse
+		supportsPosition bool
+		want             int
+	}{
+		{"closed", &api.CoverStateResponse{Position: 0}, true, 0},
+		{"open", &api.CoverStateResponse{Position: 1}, true, 100},
+		{"partly open", &api.CoverStateResponse{Position: 0.333}, true, 33},
+		{"legacy open", &api.CoverStateResponse{LegacyState: api.LegacyCoverState_LEGACY_COVER_STATE_OPEN}, false, 100},
+		{"legacy closed", &api.CoverStateResponse{LegacyState: api.LegacyCoverState_LEGACY_COVER_STATE_CLOSED}, false, 0},
+		{"partly open without position", &api.CoverStateResponse{Position: 0.3}, false, 100},
+	}
+	for _, tt := range tests {
+		if got := coverPosition(tt.msg, tt.supportsPosition); got != tt.want {
+			t.Errorf("%s: coverPosition = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTiltAngle(t *testing.T) {
+	tests := map[float32]int{0: -90, 0.5: 0, 1: 90, 0.25: -45}
+	for tilt, want := range tests {
+		if got := tiltAngle(tilt); got != want {
+			t.Errorf("tiltAngle(%v) = %d, want %d", tilt, got, want)
+		}
+	}
+}
+
+func TestDoorState(t *testing.T) {
+	tests := []struct {
+		name             string
+		msg              *api.CoverStateResponse
+		supportsPosition bool
+		want             int
+	}{
+		{"opening", &api.CoverStateResponse{CurrentOperation: api.CoverOperation_COVER_OPERATION_IS_OPENING, Position: 0.5}, true, characteristic.CurrentDoorStateOpening},
+		{"closing", &api.CoverStateResponse{CurrentOperation: api.CoverOperation_COVER_OPERATION_IS_CLOSING, Position: 0.5}, true, characteristic.CurrentDoorStateClosing},
+		{"open", &api.CoverStateResponse{Position: 1}, true, characteristic.CurrentDoorStateOpen},
+		{"closed", &api.CoverStateResponse{Position: 0}, true, characteristic.CurrentDoorStateClosed},
+		{"stopped", &api.CoverStateResponse{Position: 0.3}, true, characteristic.CurrentDoorStateStopped},
+		{"legacy open", &api.CoverStateResponse{LegacyState: api.LegacyCoverState_LEGACY_COVER_STATE_OPEN}, false, characteristic.CurrentDoorStateOpen},
+		{"legacy closed", &api.CoverStateResponse{LegacyState: api.LegacyCoverState_LEGACY_COVER_STATE_CLOSED}, false, characteristic.CurrentDoorStateClosed},
+	}
+	for _, tt := range tests {
+		if got := doorState(tt.msg, tt.supportsPosition); got != tt.want {
+			t.Errorf("%s: doorState = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
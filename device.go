@@ -0,0 +1,361 @@
+package esphomehomekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap/accessory"
+	esphome "github.com/mycontroller-org/esphome_api/pkg/client"
+	"github.com/mycontroller-org/esphome_api/pkg/model"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+// DeviceOptions configures one esphome device
+type DeviceOptions struct {
+	Name     string                   `mapstructure:"name"`
+	Address  string                   `mapstructure:"address"`
+	Password string                   `mapstructure:"password"`
+	Entities map[string]EntityOptions `mapstructure:"entities"`
+}
+
+// EntityOptions holds per-entity options, keyed by esphome object id or glob pattern
+type EntityOptions struct {
+	Type              string        `mapstructure:"type"`
+	Name              string        `mapstructure:"name"`
+	Include           bool          `mapstructure:"include"`
+	Exclude           bool          `mapstructure:"exclude"`
+	ObstructionSensor string        `mapstructure:"obstruction_sensor"`
+	Code              string        `mapstructure:"code"`
+	ResetDelay        time.Duration `mapstructure:"reset_delay"`
+	Threshold         float64       `mapstructure:"threshold"`
+	SnapshotMaxAge    time.Duration `mapstructure:"snapshot_max_age"`
+	Equals            string        `mapstructure:"equals"`
+	Match             string        `mapstructure:"match"`
+}
+
+// time to wait for the entity list at startup and after reconnect
+const listTimeout = 30 * time.Second
+
+var errNotConnected = errors.New("device is not connected")
+
+// device is a single ESPHome node with its own connection and entities
+type device struct {
+	accessoryID   uint64
+	name          string
+	address       string
+	password      string
+	config        map[string]EntityOptions
+	mappers       []Mapper
+	clientMu      sync.RWMutex
+	esphomeClient *esphome.Client
+	clientGen     uint64 // generation of the client, messages of older ones are dropped
+	conn          connection
+
+	// hapMu serialises changes of homekit characteristics of the device,
+	// it is held by esphome updates and by homekit requests (see svc.lockDevices)
+	hapMu sync.Mutex
+
+	// mu guards fields replaced by reconnect and accessory rebuild,
+	// they are used by esphome, homekit and supervisor goroutines
+	mu          sync.Mutex
+	entities    *registry
+	listing     *registry
+	listDone    chan struct{}
+	esphomeInfo *model.HelloResponse
+	camera      *camera
+	services    []*entityService
+	own         []*accessory.A // accessories of services that are not published by the device one
+	online      bool
+
+	// cancels status updates of services of the previous accessory
+	statusCancel func()
+	// setup warnings already logged, accessory can be created many times
+	warned map[string]bool
+
+	// called after reconnect when the device lists different entities
+	onEntitiesChanged func()
+	log               *logrus.Entry
+}
+
+func newDevice(cfg DeviceOptions, backoff ReconnectOptions, mappers []Mapper, log *logrus.Logger) *device {
+	d := &device{
+		accessoryID: accessoryIDFor(cfg.Name),
+		name:        cfg.Name,
+		address:     cfg.Address,
+		password:    cfg.Password,
+		entities:    newRegistry(),
+		config:      cfg.Entities,
+		log:         log.WithField("device", cfg.Name),
+	}
+	d.mappers = d.newMappers(mappers)
+	d.conn.backoff = backoff.withDefaults()
+	d.conn.rnd = rand.New(rand.NewSource(time.Now().UnixNano() + int64(d.accessoryID)))
+	d.watchConnection(func(ev connectionEvent) {
+		d.setOnline(ev.To == stateConnected)
+	})
+	return d
+}
+
+// warnOnce logs setup warning about the entity only the first time
+func (d *device) warnOnce(e *Entity, log *logrus.Entry, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+
+	d.mu.Lock()
+	if d.warned == nil {
+		d.warned = make(map[string]bool)
+	}
+	key := e.ID + "\x00" + msg
+	warned := d.warned[key]
+	d.warned[key] = true
+	d.mu.Unlock()
+
+	if !warned {
+		log.Warn(msg)
+	}
+}
+
+// accessoryIDFor returns a stable accessory id for the device name,
+// so the accessory keeps its id when devices are added, removed or reordered.
+// Ids 0 and 1 are reserved (1 is used by the bridge itself).
+func accessoryIDFor(name string) uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	id := uint64(h.Sum32())
+	if id < 2 {
+		id += 2
+	}
+	return id
+}
+
+// entityConfig returns config options for the entity (empty if not configured).
+// Options for the exact object id take precedence, otherwise the first matching
+// glob pattern (in alphabetical order) is used.
+func (d *device) entityConfig(e *Entity) EntityOptions {
+	if cfg, ok := d.config[e.ID]; ok {
+		return cfg
+	}
+
+	patterns := make([]string, 0, len(d.config))
+	for pattern := range d.config {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, e.ID); ok {
+			return d.config[pattern]
+		}
+	}
+	return EntityOptions{}
+}
+
+// client returns the current esphome client, nil while the device is not connected
+func (d *device) client() *esphome.Client {
+	d.clientMu.RLock()
+	defer d.clientMu.RUnlock()
+	return d.esphomeClient
+}
+
+// Send sends message to esphome, it fails while the device is not connected
+func (d *device) Send(msg proto.Message) error {
+	client := d.client()
+	if client == nil {
+		return errNotConnected
+	}
+	return client.Send(msg)
+}
+
+func (d *device) connectToESPHome() (err error) {
+
+	// previous connection is closed first, so it does not deliver messages anymore
+	d.closeClient()
+
+	d.clientMu.Lock()
+	d.clientGen++
+	gen := d.clientGen
+	d.clientMu.Unlock()
+
+	client, err := esphome.Init(d.name, d.address, time.Second*10, d.clientHandler(gen))
+	if err != nil {
+		d.log.WithError(err).Error("unable to init client")
+		return
+	}
+
+	d.clientMu.Lock()
+	d.esphomeClient = client
+	d.clientMu.Unlock()
+
+	helloResponse, err := client.Hello()
+	if err != nil {
+		d.log.WithError(err).Error("no answer from hello")
+		return
+	}
+	d.log.Debugf("hello response : %v", helloResponse)
+
+	err = client.Login(d.password)
+	if err != nil {
+		d.log.WithError(err).Error("unable to login to client")
+		return
+	}
+
+	d.mu.Lock()
+	d.esphomeInfo = helloResponse
+	d.mu.Unlock()
+	return
+}
+
+// listEntities requests entities from esphome, they are collected
+// in a new listing until the returned channel is closed
+func (d *device) listEntities(ctx context.Context) (done <-chan struct{}, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	client := d.client()
+	if client == nil {
+		return nil, errNotConnected
+	}
+
+	d.mu.Lock()
+	d.listing = newRegistry()
+	d.listDone = make(chan struct{})
+	done = d.listDone
+	d.mu.Unlock()
+
+	return done, client.ListEntities()
+}
+
+// finishListing is called when esphome has sent all entities
+func (d *device) finishListing() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.listDone != nil {
+		close(d.listDone)
+		d.listDone = nil
+	}
+}
+
+// useListing replaces entities by the last listing if they differ,
+// it reports whether entities changed
+func (d *device) useListing() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.listing == nil || d.entities.equal(d.listing) {
+		return false
+	}
+	d.entities = d.listing
+	return true
+}
+
+func (d *device) currentEntities() *registry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.entities
+}
+
+// currentListing returns registry collecting listed entities
+// (entities listed without request are collected in a new one)
+func (d *device) currentListing() *registry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.listing == nil {
+		d.listing = newRegistry()
+	}
+	return d.listing
+}
+
+func (d *device) currentCamera() *camera {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.camera
+}
+
+func (d *device) info() *model.HelloResponse {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.esphomeInfo
+}
+
+// subscribeStates asks esphome to send states of all entities
+func (d *device) subscribeStates() error {
+	client := d.client()
+	if client == nil {
+		return errNotConnected
+	}
+	return client.SubscribeStates()
+}
+
+// reconnect connects to esphome again, lists its entities and subscribes for states.
+// Entities changed by a firmware update are published with onEntitiesChanged.
+func (d *device) reconnect(ctx context.Context) (err error) {
+	err = d.connectToESPHome()
+	if err != nil {
+		return
+	}
+
+	done, err := d.listEntities(ctx)
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(listTimeout):
+		return errors.New("timeout listing entities")
+	}
+
+	if d.useListing() {
+		d.log.Info("entities changed, updating homekit accessory")
+		if d.onEntitiesChanged != nil {
+			d.onEntitiesChanged()
+		}
+	}
+
+	return d.subscribeStates()
+}
+
+// clientHandler binds esphome handler to the client of given generation,
+// messages of clients that were closed or replaced are dropped
+func (d *device) clientHandler(gen uint64) func(proto.Message) {
+	return func(m proto.Message) {
+		d.clientMu.RLock()
+		current := d.clientGen == gen
+		d.clientMu.RUnlock()
+
+		if !current {
+			d.log.Debugf("dropping message of replaced esphome client: %T", m)
+			return
+		}
+		d.esphomeHandler(m)
+	}
+}
+
+// closeClient disconnects from esphome, the client is not used anymore
+func (d *device) closeClient() {
+	d.clientMu.Lock()
+	client := d.esphomeClient
+	d.esphomeClient = nil
+	d.clientGen++
+	d.clientMu.Unlock()
+
+	if client != nil {
+		err := client.Close()
+		if err != nil {
+			d.log.WithError(err).Debug("unable to close esphome client")
+		}
+	}
+
+	if c := d.currentCamera(); c != nil {
+		c.reset()
+	}
+}
@@ -0,0 +1,58 @@
+package esphomehomekit
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestDevice() *device {
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	return newDevice(DeviceOptions{Name: "test", Address: "localhost:6053"}, ReconnectOptions{}, nil, log)
+}
+
+func TestAccessoryIDFor(t *testing.T) {
+	for _, name := range []string{"kitchen", "garage", "living room"} {
+		id := accessoryIDFor(name)
+		if id <= 1 {
+			t.Errorf("accessoryIDFor(%q) = %d, ids 0 and 1 are reserved", name, id)
+		}
+		if id != accessoryIDFor(name) {
+			t.Errorf("accessoryIDFor(%q) is not stable", name)
+		}
+	}
+	if accessoryIDFor("kitchen") == accessoryIDFor("garage") {
+		t.Error("different names have the same accessory id")
+	}
+}
+
+func TestEntityConfig(t *testing.T) {
+	d := &device{config: map[string]EntityOptions{
+		"relay_1":    {Type: "valve"},
+		"relay_*":    {Type: "outlet"},
+		"relay_?":    {Type: "fan"},
+		"*_uptime":   {Exclude: true},
+		"garage_*":   {Name: "Garage"},
+		"garage_do*": {Name: "Door"},
+	}}
+
+	tests := []struct {
+		id   string
+		want EntityOptions
+	}{
+		// exact object id is used before patterns
+		{"relay_1", EntityOptions{Type: "valve"}},
+		// patterns are tried in alphabetical order
+		{"relay_2", EntityOptions{Type: "outlet"}},
+		{"relay_10", EntityOptions{Type: "outlet"}},
+		{"wifi_uptime", EntityOptions{Exclude: true}},
+		{"garage_door", EntityOptions{Name: "Garage"}},
+		{"light", EntityOptions{}},
+	}
+	for _, tt := range tests {
+		if got := d.entityConfig(&Entity{ID: tt.id}); got != tt.want {
+			t.Errorf("entityConfig(%s) = %+v, want %+v", tt.id, got, tt.want)
+		}
+	}
+}
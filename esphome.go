@@ -1,25 +1,11 @@
 package esphomehomekit
 
 import (
-	"sort"
-
+	"github.com/brutella/hap/service"
 	"github.com/mycontroller-org/esphome_api/pkg/api"
-	"github.com/sirupsen/logrus"
 	"google.golang.org/protobuf/proto"
 )
 
-type entity struct {
-	Key       uint32
-	ID        string
-	Name      string
-	Type      EntityType
-	Info      interface{}
-	LastState interface{}
-	OnUpdate  func(newState interface{})
-}
-
-type EntryMap map[uint32]*entity
-
 type EntityType int
 
 const (
@@ -40,341 +26,247 @@ const (
 	EntityTypeMediaPlayer
 )
 
-func (em *EntryMap) sorted() (entities []*entity) {
-
-	keys := make([]int, 0, len(*em))
-	for k := range *em {
-		keys = append(keys, int(k))
-	}
-	sort.Ints(keys)
+// entityDomains are esphome domains of entity types, object ids are unique only within a domain
+var entityDomains = map[EntityType]string{
+	EntityTypeBinarySensor: "binary_sensor",
+	EntityTypeCover:        "cover",
+	EntityTypeFan:          "fan",
+	EntityTypeLight:        "light",
+	EntityTypeSensor:       "sensor",
+	EntityTypeSwitch:       "switch",
+	EntityTypeTextSensor:   "text_sensor",
+	EntityTypeCamera:       "camera",
+	EntityTypeClimate:      "climate",
+	EntityTypeNumber:       "number",
+	EntityTypeSelect:       "select",
+	EntityTypeLock:         "lock",
+	EntityTypeButton:       "button",
+	EntityTypeMediaPlayer:  "media_player",
+}
 
-	entities = make([]*entity, len(keys))
-	for i, id := range keys {
-		entities[i] = (*em)[uint32(id)]
+// entityDomain returns esphome domain of the entity type
+func entityDomain(t EntityType) string {
+	if domain, ok := entityDomains[t]; ok {
+		return domain
 	}
-	return
+	return "unknown"
 }
 
-func (s *svc) esphomeHandler(m proto.Message) {
-
-	logrus.Debugf("message received : %+v", m)
-
-	switch api.TypeID(m) {
-
-	// List response
-
-	case api.ListEntitiesBinarySensorResponseTypeID:
-		msg := m.(*api.ListEntitiesBinarySensorResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeBinarySensor,
-			Info: msg,
-		}
-
-	case api.ListEntitiesCoverResponseTypeID:
-		msg := m.(*api.ListEntitiesCoverResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeCover,
-			Info: msg,
-		}
+// listResponse is implemented by all esphome ListEntities...Response messages
+type listResponse interface {
+	proto.Message
+	GetKey() uint32
+	GetObjectId() string
+	GetName() string
+}
 
-	case api.ListEntitiesFanResponseTypeID:
-		msg := m.(*api.ListEntitiesFanResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeFan,
-			Info: msg,
-		}
+// entityKind describes one esphome entity type, its messages and homekit service
+type entityKind struct {
+	Type      EntityType
+	ListType  uint64 // type id of the list response
+	StateType uint64 // type id of the state response, 0 for entities without state
+	// key returns entity key from the state response (GetKey of the message by default)
+	key func(m proto.Message) uint32
+	// create is the built-in mapper of the entity type
+	create func(d *device, e *Entity) (*service.S, error)
+	// types are values of the type option accepted by the built-in mapper
+	types []string
+}
 
-	case api.ListEntitiesLightResponseTypeID:
-		msg := m.(*api.ListEntitiesLightResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeLight,
-			Info: msg,
-		}
+var (
+	entityTypes []EntityType // in order of registration
+	entityKinds = make(map[EntityType]*entityKind)
+	listKinds   = make(map[uint64]*entityKind)
+	stateKinds  = make(map[uint64]*entityKind)
+)
 
-	case api.ListEntitiesSensorResponseTypeID:
-		msg := m.(*api.ListEntitiesSensorResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeSensor,
-			Info: msg,
-		}
+// registerEntityKind adds entity type to dispatch tables of esphome messages
+func registerEntityKind(k *entityKind) {
+	if k.key == nil {
+		k.key = messageKey
+	}
+	if _, ok := entityKinds[k.Type]; !ok {
+		entityTypes = append(entityTypes, k.Type)
+	}
+	entityKinds[k.Type] = k
+	listKinds[k.ListType] = k
+	if k.StateType != 0 {
+		stateKinds[k.StateType] = k
+	}
+}
 
-	case api.ListEntitiesSwitchResponseTypeID:
-		msg := m.(*api.ListEntitiesSwitchResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeSwitch,
-			Info: msg,
+// acceptsType reports whether the type option can be used for entities of the kind
+func (k *entityKind) acceptsType(t string) bool {
+	for _, x := range k.types {
+		if x == t {
+			return true
 		}
+	}
+	return false
+}
 
-	case api.ListEntitiesTextSensorResponseTypeID:
-		msg := m.(*api.ListEntitiesTextSensorResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeTextSensor,
-			Info: msg,
+// validEntityType reports whether the type option is accepted by any entity kind
+func validEntityType(t string) bool {
+	for _, k := range entityKinds {
+		if k.acceptsType(t) {
+			return true
 		}
+	}
+	return false
+}
 
-	case api.ListEntitiesCameraResponseTypeID:
-		msg := m.(*api.ListEntitiesCameraResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeCamera,
-			Info: msg,
-		}
+func messageKey(m proto.Message) uint32 {
+	if msg, ok := m.(interface{ GetKey() uint32 }); ok {
+		return msg.GetKey()
+	}
+	return 0
+}
 
-	case api.ListEntitiesClimateResponseTypeID:
-		msg := m.(*api.ListEntitiesClimateResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeClimate,
-			Info: msg,
-		}
+// types of binary sensor services, used by text sensors with a rule as well
+var binarySensorServiceTypes = []string{"contact", "motion", "occupancy", "leak", "smoke", "carbon_monoxide", "doorbell", "programmable_switch"}
+
+func init() {
+	registerEntityKind(&entityKind{
+		Type:      EntityTypeBinarySensor,
+		ListType:  api.ListEntitiesBinarySensorResponseTypeID,
+		StateType: api.BinarySensorStateResponseTypeID,
+		create:    (*device).createBinarySensorService,
+		types:     binarySensorServiceTypes,
+	})
+	registerEntityKind(&entityKind{
+		Type:      EntityTypeCover,
+		ListType:  api.ListEntitiesCoverResponseTypeID,
+		StateType: api.CoverStateResponseTypeID,
+		create:    (*device).createCoverService,
+	})
+	registerEntityKind(&entityKind{
+		Type:      EntityTypeFan,
+		ListType:  api.ListEntitiesFanResponseTypeID,
+		StateType: api.FanStateResponseTypeID,
+		create:    (*device).createFanService,
+	})
+	registerEntityKind(&entityKind{
+		Type:      EntityTypeLight,
+		ListType:  api.ListEntitiesLightResponseTypeID,
+		StateType: api.LightStateResponseTypeID,
+		create:    (*device).createLightService,
+	})
+	registerEntityKind(&entityKind{
+		Type:      EntityTypeSensor,
+		ListType:  api.ListEntitiesSensorResponseTypeID,
+		StateType: api.SensorStateResponseTypeID,
+		create:    (*device).createSensorService,
+	})
+	registerEntityKind(&entityKind{
+		Type:      EntityTypeSwitch,
+		ListType:  api.ListEntitiesSwitchResponseTypeID,
+		StateType: api.SwitchStateResponseTypeID,
+		create:    (*device).createSwichService,
+		types:     []string{"outlet", "valve", "fan"},
+	})
+	registerEntityKind(&entityKind{
+		Type:      EntityTypeTextSensor,
+		ListType:  api.ListEntitiesTextSensorResponseTypeID,
+		StateType: api.TextSensorStateResponseTypeID,
+		create:    (*device).createTextSensorService,
+		types:     binarySensorServiceTypes,
+	})
+	registerEntityKind(&entityKind{
+		Type:     EntityTypeCamera,
+		ListType: api.ListEntitiesCameraResponseTypeID,
+		create:   (*device).createCameraService,
+	})
+	registerEntityKind(&entityKind{
+		Type:      EntityTypeClimate,
+		ListType:  api.ListEntitiesClimateResponseTypeID,
+		StateType: api.ClimateStateResponseTypeID,
+		create:    (*device).createClimateService,
+		types:     []string{"thermostat", "heater_cooler"},
+	})
+	registerEntityKind(&entityKind{
+		Type:      EntityTypeNumber,
+		ListType:  api.ListEntitiesNumberResponseTypeID,
+		StateType: api.NumberStateResponseTypeID,
+		create:    (*device).createNumberService,
+		types:     []string{"light", "fan", "custom"},
+	})
+	registerEntityKind(&entityKind{
+		Type:      EntityTypeSelect,
+		ListType:  api.ListEntitiesSelectResponseTypeID,
+		StateType: api.SelectStateResponseTypeID,
+		create:    (*device).createSelectService,
+		types:     []string{"switches", "television"},
+	})
+	registerEntityKind(&entityKind{
+		Type:      EntityTypeLock,
+		ListType:  api.ListEntitiesLockResponseTypeID,
+		StateType: api.LockStateResponseTypeID,
+		create:    (*device).createLockService,
+	})
+	registerEntityKind(&entityKind{
+		Type:     EntityTypeButton,
+		ListType: api.ListEntitiesButtonResponseTypeID,
+		create:   (*device).createButtonService,
+	})
+	registerEntityKind(&entityKind{
+		Type:      EntityTypeMediaPlayer,
+		ListType:  api.ListEntitiesMediaPlayerResponseTypeID,
+		StateType: api.MediaPlayerStateResponseTypeID,
+		create:    (*device).createMediaPlayerService,
+	})
+}
 
-	case api.ListEntitiesNumberResponseTypeID:
-		msg := m.(*api.ListEntitiesNumberResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeNumber,
-			Info: msg,
-		}
+func (d *device) esphomeHandler(m proto.Message) {
 
-	case api.ListEntitiesSelectResponseTypeID:
-		msg := m.(*api.ListEntitiesSelectResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeSelect,
-			Info: msg,
-		}
+	d.log.Debugf("message received : %+v", m)
 
-	case api.ListEntitiesLockResponseTypeID:
-		msg := m.(*api.ListEntitiesLockResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeLock,
-			Info: msg,
-		}
+	typeID := api.TypeID(m)
 
-	case api.ListEntitiesButtonResponseTypeID:
-		msg := m.(*api.ListEntitiesButtonResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeButton,
-			Info: msg,
+	// List response
+	if kind, ok := listKinds[typeID]; ok {
+		msg, ok := m.(listResponse)
+		if !ok {
+			return
 		}
-
-	case api.ListEntitiesMediaPlayerResponseTypeID:
-		msg := m.(*api.ListEntitiesMediaPlayerResponse)
-		s.entities[msg.Key] = &entity{
-			Key:  msg.Key,
-			ID:   msg.ObjectId,
-			Name: msg.Name,
-			Type: EntityTypeMediaPlayer,
+		d.currentListing().add(&Entity{
+			Key:  msg.GetKey(),
+			ID:   msg.GetObjectId(),
+			Name: msg.GetName(),
+			Type: kind.Type,
 			Info: msg,
-		}
-
-	// List Done
-
-	case api.ListEntitiesDoneResponseTypeID:
-		{
-			logrus.Tracef("entities: %+v", s.entities)
-			logrus.Debug("start subscribe for states")
-
-			err := s.initializeHomeKit(s.ctx)
-			if err != nil {
-				logrus.WithError(err).Error("unable to initialize homekit")
-			}
-
-			err = s.esphomeClient.SubscribeStates()
-			if err != nil {
-				logrus.WithError(err).Error("unable to subscribe for states")
-			}
-		}
+		})
+		return
+	}
 
 	// States
-
-	case api.BinarySensorStateResponseTypeID:
-		msg := m.(*api.BinarySensorStateResponse)
-		entity, ok := s.entities[msg.Key]
-		if !ok {
-			logrus.Errorf("received state for unknown key: %s", msg.Key)
-			break
-		}
-		entity.LastState = msg
-		if entity.OnUpdate != nil {
-			entity.OnUpdate(msg)
-		}
-		s.entities[msg.Key] = entity
-
-	case api.CoverStateResponseTypeID:
-		msg := m.(*api.CoverStateResponse)
-		entity, ok := s.entities[msg.Key]
-		if !ok {
-			logrus.Errorf("received state for unknown key: %s", msg.Key)
-			break
-		}
-		entity.LastState = msg
-		if entity.OnUpdate != nil {
-			entity.OnUpdate(msg)
-		}
-		s.entities[msg.Key] = entity
-
-	case api.FanStateResponseTypeID:
-		msg := m.(*api.FanStateResponse)
-		entity, ok := s.entities[msg.Key]
-		if !ok {
-			logrus.Errorf("received state for unknown key: %s", msg.Key)
-			break
-		}
-		entity.LastState = msg
-		if entity.OnUpdate != nil {
-			entity.OnUpdate(msg)
-		}
-		s.entities[msg.Key] = entity
-
-	case api.LightStateResponseTypeID:
-		msg := m.(*api.LightStateResponse)
-		entity, ok := s.entities[msg.Key]
-		if !ok {
-			logrus.Errorf("received state for unknown key: %s", msg.Key)
-			break
-		}
-		entity.LastState = msg
-		if entity.OnUpdate != nil {
-			entity.OnUpdate(msg)
-		}
-		s.entities[msg.Key] = entity
-
-	case api.SensorStateResponseTypeID:
-		msg := m.(*api.SensorStateResponse)
-		entity, ok := s.entities[msg.Key]
-		if !ok {
-			logrus.Errorf("received state for unknown key: %s", msg.Key)
-			break
-		}
-		entity.LastState = msg
-		if entity.OnUpdate != nil {
-			entity.OnUpdate(msg)
-		}
-		s.entities[msg.Key] = entity
-
-	case api.SwitchStateResponseTypeID:
-		msg := m.(*api.SwitchStateResponse)
-		entity, ok := s.entities[msg.Key]
-		if !ok {
-			logrus.Errorf("received state for unknown key: %s", msg.Key)
-			break
-		}
-		entity.LastState = msg
-		if entity.OnUpdate != nil {
-			entity.OnUpdate(msg)
-		}
-		s.entities[msg.Key] = entity
-
-	case api.TextSensorStateResponseTypeID:
-		msg := m.(*api.TextSensorStateResponse)
-		entity, ok := s.entities[msg.Key]
+	if kind, ok := stateKinds[typeID]; ok {
+		key := kind.key(m)
+		d.hapMu.Lock()
+		ok := d.currentEntities().update(key, m)
+		d.hapMu.Unlock()
 		if !ok {
-			logrus.Errorf("received state for unknown key: %s", msg.Key)
-			break
+			d.log.Errorf("received state for unknown key: %d", key)
 		}
-		entity.LastState = msg
-		if entity.OnUpdate != nil {
-			entity.OnUpdate(msg)
-		}
-		s.entities[msg.Key] = entity
+		return
+	}
 
-	case api.ClimateStateResponseTypeID:
-		msg := m.(*api.ClimateStateResponse)
-		entity, ok := s.entities[msg.Key]
-		if !ok {
-			logrus.Errorf("received state for unknown key: %s", msg.Key)
-			break
-		}
-		entity.LastState = msg
-		s.entities[msg.Key] = entity
+	switch typeID {
 
-	case api.NumberStateResponseTypeID:
-		msg := m.(*api.NumberStateResponse)
-		entity, ok := s.entities[msg.Key]
-		if !ok {
-			logrus.Errorf("received state for unknown key: %s", msg.Key)
-			break
-		}
-		entity.LastState = msg
-		if entity.OnUpdate != nil {
-			entity.OnUpdate(msg)
-		}
-		s.entities[msg.Key] = entity
+	// List Done
 
-	case api.SelectStateResponseTypeID:
-		msg := m.(*api.SelectStateResponse)
-		entity, ok := s.entities[msg.Key]
-		if !ok {
-			logrus.Errorf("received state for unknown key: %s", msg.Key)
-			break
-		}
-		entity.LastState = msg
-		if entity.OnUpdate != nil {
-			entity.OnUpdate(msg)
-		}
-		s.entities[msg.Key] = entity
+	case api.ListEntitiesDoneResponseTypeID:
+		d.finishListing()
 
-	case api.LockStateResponseTypeID:
-		msg := m.(*api.LockStateResponse)
-		entity, ok := s.entities[msg.Key]
-		if !ok {
-			logrus.Errorf("received state for unknown key: %s", msg.Key)
-			break
-		}
-		entity.LastState = msg
-		if entity.OnUpdate != nil {
-			entity.OnUpdate(msg)
-		}
-		s.entities[msg.Key] = entity
+	// Camera images
 
-	case api.MediaPlayerStateResponseTypeID:
-		msg := m.(*api.MediaPlayerStateResponse)
-		entity, ok := s.entities[msg.Key]
-		if !ok {
-			logrus.Errorf("received state for unknown key: %s", msg.Key)
+	case api.CameraImageResponseTypeID:
+		msg := m.(*api.CameraImageResponse)
+		camera := d.currentCamera()
+		if camera == nil || camera.key != msg.Key {
+			d.log.Errorf("received camera image for unknown key: %d", msg.Key)
 			break
 		}
-		entity.LastState = msg
-		if entity.OnUpdate != nil {
-			entity.OnUpdate(msg)
-		}
-		s.entities[msg.Key] = entity
+		camera.receive(msg)
 
 	}
 
@@ -0,0 +1,175 @@
+package esphomehomekit
+
+import (
+	"math"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+// legacyFanSpeeds are speeds of fans that do not report speed count (older esphome versions)
+var legacyFanSpeeds = []api.FanSpeed{
+	api.FanSpeed_FAN_SPEED_LOW,
+	api.FanSpeed_FAN_SPEED_MEDIUM,
+	api.FanSpeed_FAN_SPEED_HIGH,
+}
+
+// fanSpeedLevel converts homekit percentage to the nearest esphome speed level (1 - count)
+func fanSpeedLevel(percentage float64, count int) int {
+	level := int(math.Round(percentage * float64(count) / 100))
+	if level < 1 {
+		level = 1
+	} else if level > count {
+		level = count
+	}
+	return level
+}
+
+// fanSpeedPercentage converts esphome speed level (1 - count) to homekit percentage
+func fanSpeedPercentage(level int, count int) float64 {
+	return float64(level) * 100 / float64(count)
+}
+
+func (d *device) createFanService(e *Entity) (sv *service.S, err error) {
+
+	supportsSpeed := false
+	supportsOscillation := false
+	supportsDirection := false
+	speedCount := 0
+	legacySpeed := false
+
+	info, ok := e.Info.(*api.ListEntitiesFanResponse)
+	if ok {
+		supportsSpeed = info.SupportsSpeed
+		supportsOscillation = info.SupportsOscillation
+		supportsDirection = info.SupportsDirection
+		speedCount = int(info.SupportedSpeedCount)
+		if supportsSpeed && speedCount == 0 {
+			legacySpeed = true
+			speedCount = len(legacyFanSpeeds)
+		}
+	}
+
+	k := service.NewFanV2()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	speed := characteristic.NewRotationSpeed()
+	if supportsSpeed {
+		speed.SetStepValue(100 / float64(speedCount))
+		k.AddC(speed.C)
+	}
+
+	swing := characteristic.NewSwingMode()
+	if supportsOscillation {
+		k.AddC(swing.C)
+	}
+
+	direction := characteristic.NewRotationDirection()
+	if supportsDirection {
+		k.AddC(direction.C)
+	}
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.FanStateResponse)
+		if ok {
+			if msg.State {
+				k.Active.SetValue(characteristic.ActiveActive)
+			} else {
+				k.Active.SetValue(characteristic.ActiveInactive)
+			}
+
+			if supportsSpeed {
+				level := int(msg.SpeedLevel)
+				if legacySpeed {
+					level = int(msg.Speed) + 1
+				}
+				if level > 0 {
+					speed.SetValue(fanSpeedPercentage(level, speedCount))
+				}
+			}
+
+			if supportsOscillation {
+				if msg.Oscillating {
+					swing.SetValue(characteristic.SwingModeSwingEnabled)
+				} else {
+					swing.SetValue(characteristic.SwingModeSwingDisabled)
+				}
+			}
+
+			if supportsDirection {
+				if msg.Direction == api.FanDirection_FAN_DIRECTION_REVERSE {
+					direction.SetValue(characteristic.RotationDirectionCounterclockwise)
+				} else {
+					direction.SetValue(characteristic.RotationDirectionClockwise)
+				}
+			}
+		} else {
+			d.log.Errorf("unexpected state for fan : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	k.Active.OnSetRemoteValue(func(v int) error {
+		newState := v == characteristic.ActiveActive
+
+		return d.Send(&api.FanCommandRequest{
+			Key:      e.Key,
+			State:    newState,
+			HasState: true,
+		})
+	})
+
+	speed.OnSetRemoteValue(func(v float64) error {
+		if v <= 0 {
+			return d.Send(&api.FanCommandRequest{
+				Key:      e.Key,
+				State:    false,
+				HasState: true,
+			})
+		}
+
+		level := fanSpeedLevel(v, speedCount)
+		if legacySpeed {
+			return d.Send(&api.FanCommandRequest{
+				Key:      e.Key,
+				HasSpeed: true,
+				Speed:    legacyFanSpeeds[level-1],
+			})
+		}
+
+		return d.Send(&api.FanCommandRequest{
+			Key:           e.Key,
+			HasSpeedLevel: true,
+			SpeedLevel:    int32(level),
+		})
+	})
+
+	swing.OnSetRemoteValue(func(v int) error {
+		return d.Send(&api.FanCommandRequest{
+			Key:            e.Key,
+			HasOscillating: true,
+			Oscillating:    v == characteristic.SwingModeSwingEnabled,
+		})
+	})
+
+	direction.OnSetRemoteValue(func(v int) error {
+		dir := api.FanDirection_FAN_DIRECTION_FORWARD
+		if v == characteristic.RotationDirectionCounterclockwise {
+			dir = api.FanDirection_FAN_DIRECTION_REVERSE
+		}
+
+		return d.Send(&api.FanCommandRequest{
+			Key:          e.Key,
+			HasDirection: true,
+			Direction:    dir,
+		})
+	})
+
+	sv = k.S
+	return
+}
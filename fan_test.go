@@ -0,0 +1,39 @@
+package esphomehomekit
+
+import "testing"
+
+func TestFanSpeedLevel(t *testing.T) {
+	tests := []struct {
+		percentage float64
+		count      int
+		want       int
+	}{
+		{0, 3, 1},
+		{1, 3, 1},
+		{33.3, 3, 1},
+		{40, 3, 1},
+		{60, 3, 2},
+		{66.7, 3, 2},
+		{83, 3, 2},
+		{84, 3, 3},
+		{100, 3, 3},
+		{150, 3, 3},
+		{50, 100, 50},
+		{100, 1, 1},
+	}
+	for _, tt := range tests {
+		if got := fanSpeedLevel(tt.percentage, tt.count); got != tt.want {
+			t.Errorf("fanSpeedLevel(%v, %d) = %d, want %d", tt.percentage, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestFanSpeedRoundTrip(t *testing.T) {
+	for _, count := range []int{1, 2, 3, 4, 6, 100} {
+		for level := 1; level <= count; level++ {
+			if got := fanSpeedLevel(fanSpeedPercentage(level, count), count); got != level {
+				t.Errorf("speed level %d of %d is converted back to %d", level, count, got)
+			}
+		}
+	}
+}
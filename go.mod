@@ -4,6 +4,8 @@ go 1.17
 
 require (
 	github.com/brutella/hap v0.0.14
+	github.com/go-chi/chi v1.5.4
+	github.com/mitchellh/mapstructure v1.5.0
 	github.com/mycontroller-org/esphome_api v1.1.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/pflag v1.0.5
@@ -14,11 +16,9 @@ require (
 require (
 	github.com/brutella/dnssd v1.2.2 // indirect
 	github.com/fsnotify/fsnotify v1.5.4 // indirect
-	github.com/go-chi/chi v1.5.4 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/magiconair/properties v1.8.6 // indirect
 	github.com/miekg/dns v1.1.49 // indirect
-	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/pelletier/go-toml v1.9.5 // indirect
 	github.com/pelletier/go-toml/v2 v2.0.2 // indirect
 	github.com/spf13/afero v1.8.2 // indirect
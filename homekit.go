@@ -4,167 +4,171 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/brutella/hap"
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
 	"github.com/brutella/hap/service"
+	"github.com/go-chi/chi"
 	"github.com/mycontroller-org/esphome_api/pkg/api"
-	"github.com/sirupsen/logrus"
 )
 
-func (s *svc) createAccessory() (a *accessory.A, err error) {
-	ver := fmt.Sprintf("%v.%v", s.esphomeInfo.ApiVersionMajor, s.esphomeInfo.ApiVersionMinor)
+// ownAccessoryTypes are accessory categories of services that Home app shows only
+// on an accessory of their own, they are not added to the accessory of the device
+var ownAccessoryTypes = map[string]byte{
+	service.TypeTelevision:                accessory.TypeTelevision,
+	service.TypeCameraRTPStreamManagement: accessory.TypeIPCamera,
+}
+
+// createAccessory creates accessory of the device, services that need an accessory
+// of their own are published by own accessories
+func (d *device) createAccessory() (a *accessory.A, own []*accessory.A, err error) {
+	// device that has not connected yet is published without esphome info
+	var serial, ver string
+	if info := d.info(); info != nil {
+		serial = info.ServerInfo
+		ver = fmt.Sprintf("%v.%v", info.ApiVersionMajor, info.ApiVersionMinor)
+	}
 
 	a = accessory.New(accessory.Info{
-		Name:         s.name,
-		SerialNumber: s.esphomeInfo.ServerInfo,
+		Name:         d.name,
+		SerialNumber: serial,
 		Manufacturer: "mligor",
 		Model:        "esphome-homekit",
 		Firmware:     ver,
 	}, accessory.TypeOther) // TODO: choose the right type
 
 	a.IdentifyFunc = func(r *http.Request) {
-		logrus.Debug("identify") // TODO: do something usefull, maybe Ping
+		d.log.Debug("identify") // TODO: do something usefull, maybe Ping
 	}
 
-	a.Id = 1
-	return
-}
-
-func (s *svc) createSwichService(e *entity) (sv *service.S, err error) {
+	a.Id = d.accessoryID
 
-	k := service.NewSwitch()
-	// k.On.Description = e.Name
+	registry := d.currentEntities()
+	entities := registry.snapshot()
 
-	name := characteristic.NewName()
-	name.SetValue(e.Name)
-	k.AddC(name.C)
-
-	// esphome -> homekit
-	e.OnUpdate = func(newState interface{}) {
-		msg, ok := newState.(*api.SwitchStateResponse)
-		if ok {
-			k.On.SetValue(msg.State)
-		} else {
-			logrus.Errorf("unexpected state for switch : %+v", newState)
-		}
+	// accessory can be created again when entities change,
+	// services of the previous one must not receive updates anymore
+	for _, e := range entities {
+		e.reset()
 	}
+	if d.statusCancel != nil {
+		d.statusCancel()
+	}
+	d.mu.Lock()
+	d.camera = nil
+	d.mu.Unlock()
 
-	// homekit -> esphome
-	k.On.OnSetRemoteValue(func(v bool) error {
-		return s.esphomeClient.Send(&api.SwitchCommandRequest{
-			Key:   e.Key,
-			State: v,
-		})
-	})
-	sv = k.S
-	return
-}
-
-func (s *svc) createFanService(e *entity) (sv *service.S, err error) {
-
-	//TODO: implement oscilating and speed
-	k := service.NewFanV2()
+	var services []*entityService
+	for _, e := range entities {
+		cfg := d.entityConfig(e)
+		if cfg.Exclude {
+			d.log.Debugf("entity %s excluded", e.ID)
+			continue
+		}
+		if cfg.Name != "" {
+			e.Name = cfg.Name
+		}
 
-	name := characteristic.NewName()
-	name.SetValue(e.Name)
-	k.AddC(name.C)
+		svc, err := d.createService(e)
+		if err != nil {
+			d.log.WithError(err).Error("unable to create service")
+			continue
+		}
+		if svc == nil {
+			continue
+		}
+		d.log.WithField("svc", svc.Type).Debug("added new service")
+
+		sa := a
+		if typ, ok := ownAccessoryTypes[svc.Type]; ok {
+			sa = accessory.New(accessory.Info{
+				Name:         e.Name,
+				SerialNumber: serial,
+				Manufacturer: "mligor",
+				Model:        "esphome-homekit",
+				Firmware:     ver,
+			}, typ)
+			sa.Id = accessoryIDFor(fmt.Sprintf("%s/%s.%s", d.name, entityDomain(e.Type), e.ID))
+			own = append(own, sa)
+		}
 
-	// esphome -> homekit
-	e.OnUpdate = func(newState interface{}) {
-		msg, ok := newState.(*api.FanStateResponse)
-		if ok {
-			if msg.State {
-				k.Active.SetValue(1)
-			} else {
-				k.Active.SetValue(0)
-			}
-		} else {
-			logrus.Errorf("unexpected state for switch : %+v", newState)
+		sa.AddS(svc)
+		services = append(services, newEntityService(e, svc))
+		// linked services have to be published by the accessory as well
+		for _, linked := range svc.Linked {
+			sa.AddS(linked)
+			services = append(services, newEntityService(e, linked))
 		}
 	}
 
-	// homekit -> esphome
-	k.Active.OnSetRemoteValue(func(v int) error {
-		newState := v == 1
-
-		return s.esphomeClient.Send(&api.FanCommandRequest{
-			Key:      e.Key,
-			State:    newState,
-			HasState: true,
-		})
-	})
-	sv = k.S
-	return
-}
-
-func (s *svc) createLightService(e *entity) (sv *service.S, err error) {
+	d.mu.Lock()
+	d.services = services
+	d.own = own
+	d.mu.Unlock()
 
-	supportsBrightness := false
-	//supportsRGB := false
-
-	msg, ok := e.Info.(*api.ListEntitiesLightResponse)
-	if ok {
-		for _, v := range msg.SupportedColorModes {
-			if v == api.ColorMode_COLOR_MODE_BRIGHTNESS {
-				supportsBrightness = true
-			}
-			// else if v == api.ColorMode_COLOR_MODE_RGB {
-			// 	supportsRGB = true
-			// }
+	// new services start with the last known states
+	d.hapMu.Lock()
+	defer d.hapMu.Unlock()
+	for _, e := range entities {
+		if state := e.State(); state != nil {
+			e.update(state)
 		}
 	}
 
-	k := service.NewLightbulb() // TODO: add support for RGBs
+	for _, es := range services {
+		d.updateStatus(es)
+	}
+	d.statusCancel = registry.subscribe(d.updateEntityStatus)
+	return
+}
 
-	name := characteristic.NewName()
-	name.SetValue(e.Name)
-	k.AddC(name.C)
+func (s *svc) createBridge() *accessory.A {
+	b := accessory.NewBridge(accessory.Info{
+		Name:         s.name,
+		Manufacturer: "mligor",
+		Model:        "esphome-homekit",
+	})
 
-	brightness := characteristic.NewBrightness()
-	if supportsBrightness {
-		k.AddC(brightness.C)
+	b.IdentifyFunc = func(r *http.Request) {
+		s.log.Debug("identify bridge")
 	}
 
-	// esphome -> homekit
-	e.OnUpdate = func(newState interface{}) {
-		msg, ok := newState.(*api.LightStateResponse)
-		if ok {
-			k.On.SetValue(msg.State)
+	b.Id = 1
+	return b.A
+}
 
-			if supportsBrightness {
-				brightness.SetValue(int(msg.Brightness * 100))
-			}
+// newMomentarySwitch creates switch that calls press when turned on,
+// and turns itself off after the reset delay
+func (d *device) newMomentarySwitch(name string, reset time.Duration, press func() error) *service.Switch {
 
-		} else {
-			logrus.Errorf("unexpected state for light : %+v", newState)
-		}
+	k := service.NewSwitch()
 
-	}
+	n := characteristic.NewName()
+	n.SetValue(name)
+	k.AddC(n.C)
 
-	// homekit -> esphome
 	k.On.OnSetRemoteValue(func(v bool) error {
-		return s.esphomeClient.Send(&api.LightCommandRequest{
-			Key:      e.Key,
-			State:    v,
-			HasState: true,
-		})
+		if !v {
+			return nil
+		}
+		return press()
 	})
-
-	brightness.OnSetRemoteValue(func(v int) error {
-		return s.esphomeClient.Send(&api.LightCommandRequest{
-			Key:           e.Key,
-			Brightness:    float32(v) / 100.0,
-			HasBrightness: true,
-		})
+	k.On.OnValueRemoteUpdate(func(v bool) {
+		if v {
+			time.AfterFunc(reset, func() {
+				d.hapMu.Lock()
+				defer d.hapMu.Unlock()
+				k.On.SetValue(false)
+			})
+		}
 	})
 
-	sv = k.S
-	return
+	return k
 }
 
-func (s *svc) createProgrammableSwitchService(e *entity) (sv *service.S, err error) {
+func (d *device) createProgrammableSwitchService(e *Entity) (sv *service.S, err error) {
 
 	k := service.NewStatelessProgrammableSwitch()
 	// k.ProgrammableSwitchEvent.Description = e.Name
@@ -175,7 +179,7 @@ func (s *svc) createProgrammableSwitchService(e *entity) (sv *service.S, err err
 	k.AddC(name.C)
 
 	// esphome -> homekit
-	e.OnUpdate = func(newState interface{}) {
+	e.SetOnUpdate(func(newState interface{}) {
 		msg, ok := newState.(*api.BinarySensorStateResponse)
 		if ok {
 			if msg.State {
@@ -184,9 +188,9 @@ func (s *svc) createProgrammableSwitchService(e *entity) (sv *service.S, err err
 				k.ProgrammableSwitchEvent.SetValue(1)
 			}
 		} else {
-			logrus.Errorf("unexpected state for binary sensor : %+v", newState)
+			d.log.Errorf("unexpected state for binary sensor : %+v", newState)
 		}
-	}
+	})
 
 	// homekit -> esphome
 	// nothing here, as homekit can not trigger this event
@@ -194,7 +198,7 @@ func (s *svc) createProgrammableSwitchService(e *entity) (sv *service.S, err err
 	return
 }
 
-func (s *svc) createTemperatureService(e *entity) (sv *service.S, err error) {
+func (d *device) createTemperatureService(e *Entity) (sv *service.S, err error) {
 
 	k := service.NewTemperatureSensor()
 
@@ -203,15 +207,15 @@ func (s *svc) createTemperatureService(e *entity) (sv *service.S, err error) {
 	k.AddC(name.C)
 
 	// esphome -> homekit
-	e.OnUpdate = func(newState interface{}) {
+	e.SetOnUpdate(func(newState interface{}) {
 		msg, ok := newState.(*api.SensorStateResponse)
 		if ok {
 
 			k.CurrentTemperature.SetValue(float64(msg.State))
 		} else {
-			logrus.Errorf("unexpected state for sensor : %+v", newState)
+			d.log.Errorf("unexpected state for sensor : %+v", newState)
 		}
-	}
+	})
 
 	// homekit -> esphome
 	// nothing here, as homekit can not trigger this event
@@ -219,7 +223,7 @@ func (s *svc) createTemperatureService(e *entity) (sv *service.S, err error) {
 	return
 }
 
-func (s *svc) createHumidityService(e *entity) (sv *service.S, err error) {
+func (d *device) createHumidityService(e *Entity) (sv *service.S, err error) {
 	k := service.NewHumiditySensor()
 
 	name := characteristic.NewName()
@@ -227,15 +231,15 @@ func (s *svc) createHumidityService(e *entity) (sv *service.S, err error) {
 	k.AddC(name.C)
 
 	// esphome -> homekit
-	e.OnUpdate = func(newState interface{}) {
+	e.SetOnUpdate(func(newState interface{}) {
 		msg, ok := newState.(*api.SensorStateResponse)
 		if ok {
 
 			k.CurrentRelativeHumidity.SetValue(float64(msg.State))
 		} else {
-			logrus.Errorf("unexpected state for sensor : %+v", newState)
+			d.log.Errorf("unexpected state for sensor : %+v", newState)
 		}
-	}
+	})
 
 	// homekit -> esphome
 	// nothing here, as homekit can not trigger this event
@@ -243,87 +247,218 @@ func (s *svc) createHumidityService(e *entity) (sv *service.S, err error) {
 	return
 }
 
-func (s *svc) createSensorService(e *entity) (sv *service.S, err error) {
+func (d *device) createSensorService(e *Entity) (sv *service.S, err error) {
 
 	msg, ok := e.Info.(*api.ListEntitiesSensorResponse)
 	if ok {
 
 		switch msg.DeviceClass {
 		case "temperature":
-			return s.createTemperatureService(e)
+			return d.createTemperatureService(e)
 		case "humidity":
-			return s.createHumidityService(e)
-			//TODO: implement other device classes
+			return d.createHumidityService(e)
+		case "illuminance":
+			return d.createLightSensorService(e)
+		case "carbon_dioxide":
+			return d.createCarbonDioxideService(e)
+		case "pm25", "pm10", "volatile_organic_compounds", "nitrogen_dioxide":
+			return d.createAirQualityService(e, msg.DeviceClass)
+		case "battery":
+			return d.createBatteryService(e)
 		}
+
+		d.warnOnce(e, d.log.WithField("device_class", msg.DeviceClass), "sensor %s is not supported", e.ID)
 	}
 	return
 }
 
-func (s *svc) createService(e *entity) (sv *service.S, err error) {
-
-	switch e.Type {
-	case EntityTypeSwitch:
-		return s.createSwichService(e)
-	case EntityTypeBinarySensor:
-		return s.createProgrammableSwitchService(e)
-	case EntityTypeFan:
-		return s.createFanService(e)
-	case EntityTypeLight:
-		return s.createLightService(e)
-	case EntityTypeSensor:
-		return s.createSensorService(e)
-
-		//TODO: implement other types
-	}
+func (d *device) createService(e *Entity) (sv *service.S, err error) {
 
+	for _, m := range d.mappers {
+		if m.Match(e) {
+			return m.Build(e, d)
+		}
+	}
 	return
 }
 
+// deviceByAccessoryID returns the device published as accessory with given id,
+// or the device of the service published by an accessory of its own
+func (s *svc) deviceByAccessoryID(aid uint64) *device {
+	if !s.bridge && aid == 1 {
+		return s.devices[0]
+	}
+	for _, d := range s.devices {
+		if (s.bridge && d.accessoryID == aid) || d.ownsAccessory(aid) {
+			return d
+		}
+	}
+	return nil
+}
+
+// ownsAccessory reports whether the accessory with given id publishes a service of the device
+func (d *device) ownsAccessory(aid uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, a := range d.own {
+		if a.Id == aid {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *svc) initializeHomeKit(ctx context.Context) (err error) {
+	s.homekitMu.Lock()
+	defer s.homekitMu.Unlock()
 
-	a, err := s.createAccessory()
-	if err != nil {
-		logrus.WithError(err).Error("unable to create homekit accessory")
+	return s.startHomeKit(ctx, false)
+}
+
+// rebuildHomeKit stops the homekit server and starts it again with new accessories,
+// the server publishes a new config number so paired controllers reload them
+func (s *svc) rebuildHomeKit() {
+	s.homekitMu.Lock()
+	defer s.homekitMu.Unlock()
+
+	// devices listed before homekit is started are published by initializeHomeKit
+	if s.homekitCancel == nil {
 		return
 	}
+	s.homekitCancel()
+	<-s.homekitDone
 
-	entities := s.entities.sorted()
+	err := s.startHomeKit(s.ctx, true)
+	if err != nil {
+		s.failHomeKit(fmt.Errorf("unable to rebuild homekit accessories: %w", err))
+	}
+}
 
-	for _, e := range entities {
-		svc, err := s.createService(e)
+// failHomeKit passes error of the homekit server to Run, which stops the bridge
+func (s *svc) failHomeKit(err error) {
+	select {
+	case s.homekitErr <- err:
+	default:
+		// the bridge is stopping already
+		s.log.WithError(err).Error("homekit server failed")
+	}
+}
+
+// startHomeKit creates accessories for all devices and runs the homekit server,
+// rebuilt accessories are always published with a new config number
+func (s *svc) startHomeKit(ctx context.Context, rebuild bool) (err error) {
+
+	var as, own []*accessory.A
+	for _, d := range s.devices {
+		a, o, err := d.createAccessory()
 		if err != nil {
-			logrus.WithError(err).Error("unable to create service")
-			continue
+			d.log.WithError(err).Error("unable to create homekit accessory")
+			return err
 		}
-		if svc == nil {
-			continue
-		}
-		logrus.WithField("svc", svc.Type).Debug("added new service")
-		a.AddS(svc)
+		as = append(as, a)
+		own = append(own, o...)
 	}
 
-	s.wg.Add(1)
+	// A single device without `devices` config is published directly,
+	// otherwise every device is bridged behind one bridge accessory.
+	// Own accessories of services are bridged behind the first one.
+	a := as[0]
+	if s.bridge {
+		a = s.createBridge()
+	} else {
+		a.Id = 1
+		as = nil
+	}
+	as = append(as, own...)
 
-	go func() {
-		defer s.wg.Done()
+	s.log.Debug("starting homekit server")
 
-		logrus.Debug("starting homekit server")
+	// Create the hap server.
+	fs := hap.NewFsStore(s.homekitStorageDir)
 
-		// Create the hap server.
-		fs := hap.NewFsStore(s.homekitStorageDir)
-		server, err := hap.NewServer(fs, a)
+	changed := false
+	for _, d := range s.devices {
+		c, err := d.allocateInstanceIDs(fs)
 		if err != nil {
-			logrus.WithError(err).Fatal("unable to create homekit server")
+			d.log.WithError(err).Error("unable to store homekit instance ids")
 		}
+		changed = changed || c
+	}
+	if changed || rebuild {
+		// hap server computes config hash before our ids are applied and
+		// without characteristic values (names are values too), forget
+		// the old one so the server publishes a new config number
+		fs.Delete("configHash")
+	}
 
-		server.Pin = s.homekitPIN
+	server, err := hap.NewServer(fs, a, as...)
+	if err != nil {
+		return fmt.Errorf("unable to create homekit server: %w", err)
+	}
+
+	for _, d := range s.devices {
+		d.applyInstanceIDs()
+	}
+
+	server.Pin = s.homekitPIN
+	server.ServeMux().HandleFunc("/resource", s.snapshotHandler(server))
+	s.lockRequests(server)
+
+	ctx, s.homekitCancel = context.WithCancel(ctx)
+	done := make(chan struct{})
+	s.homekitDone = done
+
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+		defer close(done)
 
 		// Run the server.
-		server.ListenAndServe(ctx)
+		err := server.ListenAndServe(ctx)
+		if err != nil && ctx.Err() == nil {
+			s.failHomeKit(err)
+		}
 
-		logrus.Debug("finishing homekit server")
+		s.log.Debug("finishing homekit server")
 
 	}()
 
 	return
 }
+
+// lockRequests wraps homekit requests that read or write characteristics,
+// so they do not run while esphome updates change values of the same characteristics
+func (s *svc) lockRequests(server *hap.Server) {
+	mux, ok := server.ServeMux().(*chi.Mux)
+	if !ok {
+		s.log.Warn("unknown homekit server router, requests are not serialised with esphome updates")
+		return
+	}
+
+	for _, route := range mux.Routes() {
+		if route.Pattern != "/accessories" && route.Pattern != "/characteristics" {
+			continue
+		}
+		for method, h := range route.Handlers {
+			if method != "*" {
+				mux.Method(method, route.Pattern, s.lockDevices(h))
+			}
+		}
+	}
+}
+
+// lockDevices returns handler that holds homekit locks of all devices while h runs
+func (s *svc) lockDevices(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, d := range s.devices {
+			d.hapMu.Lock()
+		}
+		defer func() {
+			for _, d := range s.devices {
+				d.hapMu.Unlock()
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,93 @@
+package esphomehomekit
+
+import (
+	"testing"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+func selectEntity(key uint32, id string) *Entity {
+	return &Entity{
+		Key:  key,
+		ID:   id,
+		Name: id,
+		Type: EntityTypeSelect,
+		Info: &api.ListEntitiesSelectResponse{Key: key, ObjectId: id, Name: id, Options: []string{"a", "b"}},
+	}
+}
+
+func TestCreateAccessoryOwnAccessories(t *testing.T) {
+	d := newTestDevice()
+	d.config = map[string]EntityOptions{"mode": {Type: "switches"}}
+	d.currentEntities().add(selectEntity(1, "input"))
+	d.currentEntities().add(selectEntity(2, "source"))
+	d.currentEntities().add(selectEntity(3, "mode"))
+
+	a, own, err := d.createAccessory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range a.Ss {
+		if s.Type == service.TypeTelevision {
+			t.Error("television is published by the device accessory")
+		}
+	}
+	if len(own) != 2 {
+		t.Fatalf("%d own accessories, want 2", len(own))
+	}
+	for _, o := range own {
+		if o.Type != accessory.TypeTelevision {
+			t.Errorf("accessory %s has category %d, want television", o.Name(), o.Type)
+		}
+		if o.Id == a.Id || o.Id <= 1 {
+			t.Errorf("accessory %s has id %d", o.Name(), o.Id)
+		}
+		primary := 0
+		for _, s := range o.Ss {
+			if s.Primary {
+				primary++
+			}
+		}
+		if primary != 1 {
+			t.Errorf("accessory %s has %d primary services, want 1", o.Name(), primary)
+		}
+	}
+	if own[0].Id == own[1].Id {
+		t.Error("own accessories have the same id")
+	}
+}
+
+func TestDeviceByAccessoryID(t *testing.T) {
+	d := newTestDevice()
+	d.currentEntities().add(&Entity{
+		Key:  1,
+		ID:   "door",
+		Name: "Door",
+		Type: EntityTypeCamera,
+		Info: &api.ListEntitiesCameraResponse{Key: 1, ObjectId: "door", Name: "Door"},
+	})
+
+	a, own, err := d.createAccessory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(own) != 1 || own[0].Type != accessory.TypeIPCamera {
+		t.Fatalf("camera is not published by an accessory of its own")
+	}
+
+	for _, bridge := range []bool{true, false} {
+		s := &svc{bridge: bridge, devices: []*device{d}}
+		if got := s.deviceByAccessoryID(own[0].Id); got != d {
+			t.Errorf("bridge %v: camera accessory is not found", bridge)
+		}
+		if got := s.deviceByAccessoryID(own[0].Id + 1); got != nil {
+			t.Errorf("bridge %v: unknown accessory is found", bridge)
+		}
+	}
+	if s := (&svc{bridge: true, devices: []*device{d}}); s.deviceByAccessoryID(a.Id) != d {
+		t.Error("bridged device accessory is not found")
+	}
+}
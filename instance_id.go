@@ -0,0 +1,118 @@
+package esphomehomekit
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/brutella/hap"
+)
+
+// instance ids below are left to services that are not created from entities
+// (accessory information), entity services and characteristics get ids from here
+const firstInstanceID = 100
+
+// instanceIDs keeps homekit instance ids of services and characteristics,
+// so they do not change when entities are added or removed from the firmware
+type instanceIDs struct {
+	ids     map[string]uint64
+	next    uint64
+	changed bool
+}
+
+func newInstanceIDs(ids map[string]uint64) *instanceIDs {
+	m := &instanceIDs{
+		ids:  ids,
+		next: firstInstanceID,
+	}
+	for _, id := range ids {
+		if id >= m.next {
+			m.next = id + 1
+		}
+	}
+	return m
+}
+
+// id returns stored instance id for the key, a new id is allocated for unknown keys
+func (m *instanceIDs) id(key string) uint64 {
+	id, ok := m.ids[key]
+	if !ok {
+		id = m.next
+		m.next++
+		m.ids[key] = id
+		m.changed = true
+	}
+	return id
+}
+
+// instanceIDsKey is the key of device instance ids in homekit storage
+func (d *device) instanceIDsKey() string {
+	return fmt.Sprintf("%d.instance-ids", d.accessoryID)
+}
+
+// loadInstanceIDs reads instance ids of the device stored in homekit storage
+func (d *device) loadInstanceIDs(st hap.Store) *instanceIDs {
+	ids := make(map[string]uint64)
+
+	b, err := st.Get(d.instanceIDsKey())
+	if err == nil {
+		err = json.Unmarshal(b, &ids)
+		if err != nil {
+			d.log.WithError(err).Warn("stored instance ids are invalid, new ids will be allocated")
+			ids = make(map[string]uint64)
+		}
+	}
+
+	return newInstanceIDs(ids)
+}
+
+// allocateInstanceIDs finds instance ids stored for entity services and characteristics,
+// new ids are allocated (and stored) for new entities. It reports whether any id changed.
+func (d *device) allocateInstanceIDs(st hap.Store) (changed bool, err error) {
+
+	m := d.loadInstanceIDs(st)
+
+	services := make(map[string]int)
+	for _, es := range d.entityServices() {
+
+		// object ids are unique only within esphome domain
+		key := fmt.Sprintf("%s.%s/%s", entityDomain(es.e.Type), es.e.ID, es.s.Type)
+		services[key]++
+		if n := services[key]; n > 1 {
+			key = fmt.Sprintf("%s#%d", key, n)
+		}
+		es.sid = m.id(key)
+
+		characteristics := make(map[string]int)
+		es.cids = make([]uint64, len(es.s.Cs))
+		for j, c := range es.s.Cs {
+			ckey := fmt.Sprintf("%s/%s", key, c.Type)
+			characteristics[ckey]++
+			if n := characteristics[ckey]; n > 1 {
+				ckey = fmt.Sprintf("%s#%d", ckey, n)
+			}
+			es.cids[j] = m.id(ckey)
+		}
+	}
+
+	if !m.changed {
+		return
+	}
+
+	b, err := json.Marshal(m.ids)
+	if err != nil {
+		return
+	}
+	return true, st.Set(d.instanceIDsKey(), b)
+}
+
+// applyInstanceIDs replaces instance ids given by the hap server (which depend on the order
+// of services) with allocated ids. It has to be called after the server is created,
+// as the server numbers all services and characteristics again.
+func (d *device) applyInstanceIDs() {
+	for _, es := range d.entityServices() {
+		es.s.Id = es.sid
+		for j, c := range es.s.Cs {
+			c.Id = es.cids[j]
+		}
+	}
+}
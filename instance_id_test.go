@@ -0,0 +1,84 @@
+package esphomehomekit
+
+import (
+	"testing"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/service"
+	"github.com/sirupsen/logrus"
+)
+
+func TestInstanceIDsID(t *testing.T) {
+	m := newInstanceIDs(map[string]uint64{"a": 120, "b": 105})
+	if got := m.id("a"); got != 120 || m.changed {
+		t.Errorf("id(a) = %d, changed %v, want stored id 120", got, m.changed)
+	}
+	if got := m.id("c"); got != 121 || !m.changed {
+		t.Errorf("id(c) = %d, changed %v, want new id 121", got, m.changed)
+	}
+	if got := m.id("c"); got != 121 {
+		t.Errorf("id(c) = %d again, want 121", got)
+	}
+
+	m = newInstanceIDs(make(map[string]uint64))
+	if got := m.id("a"); got != firstInstanceID {
+		t.Errorf("first id = %d, want %d", got, firstInstanceID)
+	}
+}
+
+// setServices publishes switch service for every entity of the device
+func setServices(d *device, entities ...*Entity) {
+	d.services = nil
+	for _, e := range entities {
+		d.services = append(d.services, newEntityService(e, service.NewSwitch().S))
+	}
+}
+
+func TestAllocateInstanceIDs(t *testing.T) {
+	st := hap.NewMemStore()
+	d := &device{accessoryID: 2, log: logrus.NewEntry(logrus.New())}
+
+	relay := &Entity{Key: 1, ID: "relay", Type: EntityTypeSwitch}
+	light := &Entity{Key: 2, ID: "light", Type: EntityTypeSwitch}
+	setServices(d, relay, light)
+	changed, err := d.allocateInstanceIDs(st)
+	if err != nil || !changed {
+		t.Fatalf("allocateInstanceIDs() = %v, %v, want new ids", changed, err)
+	}
+	relayID, lightID := d.services[0].sid, d.services[1].sid
+	relayCIDs := d.services[0].cids
+
+	// the same object id in another domain, and a removed entity
+	sensor := &Entity{Key: 3, ID: "relay", Type: EntityTypeBinarySensor}
+	setServices(d, sensor, relay)
+	if _, err := d.allocateInstanceIDs(st); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.services[1].sid; got != relayID {
+		t.Errorf("relay service id = %d, want %d", got, relayID)
+	}
+	for j, id := range d.services[1].cids {
+		if id != relayCIDs[j] {
+			t.Errorf("relay characteristic %d id = %d, want %d", j, id, relayCIDs[j])
+		}
+	}
+	sensorID := d.services[0].sid
+	if sensorID == relayID || sensorID == lightID {
+		t.Errorf("binary sensor got id %d of another entity", sensorID)
+	}
+
+	// removed entity keeps its id when it comes back
+	setServices(d, light, sensor, relay)
+	changed, err = d.allocateInstanceIDs(st)
+	if err != nil || changed {
+		t.Fatalf("allocateInstanceIDs() = %v, %v, want stored ids", changed, err)
+	}
+	got := []uint64{d.services[0].sid, d.services[1].sid, d.services[2].sid}
+	want := []uint64{lightID, sensorID, relayID}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("service ids = %v, want %v", got, want)
+			break
+		}
+	}
+}
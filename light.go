@@ -0,0 +1,265 @@
+package esphomehomekit
+
+import (
+	"math"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+// esphome color capabilities, color modes are combinations of them
+const (
+	colorCapabilityBrightness       = 1 << 1
+	colorCapabilityWhite            = 1 << 2
+	colorCapabilityColorTemperature = 1 << 3
+	colorCapabilityColdWarmWhite    = 1 << 4
+	colorCapabilityRGB              = 1 << 5
+)
+
+// time to wait for the other color characteristic, homekit writes hue and saturation
+// one by one and they are sent to the light in a single command
+const colorWriteDelay = 50 * time.Millisecond
+
+func hasCapability(mode api.ColorMode, capability int32) bool {
+	return int32(mode)&capability != 0
+}
+
+// colorModeWith returns the first supported mode (in preferred order) that has the capability
+func colorModeWith(modes []api.ColorMode, capability int32, preferred ...api.ColorMode) (api.ColorMode, bool) {
+	supported := make(map[api.ColorMode]bool)
+	for _, m := range modes {
+		supported[m] = true
+	}
+	for _, m := range preferred {
+		if supported[m] && hasCapability(m, capability) {
+			return m, true
+		}
+	}
+	return api.ColorMode_COLOR_MODE_UNKNOWN, false
+}
+
+// rgbToHS converts rgb (0.0 - 1.0) to hue (0° - 360°) and saturation (0% - 100%)
+func rgbToHS(r, g, b float64) (h, s float64) {
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	delta := max - min
+
+	if max > 0 {
+		s = delta / max * 100
+	}
+	if delta == 0 {
+		return
+	}
+
+	switch max {
+	case r:
+		h = math.Mod((g-b)/delta, 6)
+	case g:
+		h = (b-r)/delta + 2
+	default:
+		h = (r-g)/delta + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return
+}
+
+// hsToRGB converts hue (0° - 360°) and saturation (0% - 100%) to rgb (0.0 - 1.0) at full value
+func hsToRGB(h, s float64) (r, g, b float64) {
+	s /= 100
+	c := s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := 1 - c
+
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return r + m, g + m, b + m
+}
+
+func (d *device) createLightService(e *Entity) (sv *service.S, err error) {
+
+	supportsBrightness := false
+	supportsRGB := false
+	supportsColorTemperature := false
+	var rgbMode, ctMode api.ColorMode
+	var minMireds, maxMireds float32
+
+	info, ok := e.Info.(*api.ListEntitiesLightResponse)
+	if ok {
+		for _, v := range info.SupportedColorModes {
+			if hasCapability(v, colorCapabilityBrightness) {
+				supportsBrightness = true
+			}
+		}
+
+		// prefer plain modes, so white channels are not mixed into the color
+		rgbMode, supportsRGB = colorModeWith(info.SupportedColorModes, colorCapabilityRGB,
+			api.ColorMode_COLOR_MODE_RGB,
+			api.ColorMode_COLOR_MODE_RGB_WHITE,
+			api.ColorMode_COLOR_MODE_RGB_COLOR_TEMPERATURE,
+			api.ColorMode_COLOR_MODE_RGB_COLD_WARM_WHITE)
+		ctMode, supportsColorTemperature = colorModeWith(info.SupportedColorModes, colorCapabilityColorTemperature|colorCapabilityColdWarmWhite,
+			api.ColorMode_COLOR_MODE_COLOR_TEMPERATURE,
+			api.ColorMode_COLOR_MODE_COLD_WARM_WHITE,
+			api.ColorMode_COLOR_MODE_RGB_COLOR_TEMPERATURE,
+			api.ColorMode_COLOR_MODE_RGB_COLD_WARM_WHITE)
+
+		minMireds = info.MinMireds
+		maxMireds = info.MaxMireds
+	}
+
+	k := service.NewLightbulb()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	brightness := characteristic.NewBrightness()
+	if supportsBrightness {
+		k.AddC(brightness.C)
+	}
+
+	hue := characteristic.NewHue()
+	saturation := characteristic.NewSaturation()
+	if supportsRGB {
+		k.AddC(hue.C)
+		k.AddC(saturation.C)
+	}
+
+	colorTemperature := characteristic.NewColorTemperature()
+	if supportsColorTemperature {
+		if maxMireds > minMireds && minMireds > 0 {
+			colorTemperature.SetMinValue(int(math.Ceil(float64(minMireds))))
+			colorTemperature.SetMaxValue(int(math.Floor(float64(maxMireds))))
+			colorTemperature.SetValue(int(math.Ceil(float64(minMireds))))
+		}
+		k.AddC(colorTemperature.C)
+	}
+
+	// clampMireds limits color temperature to the range supported by the light
+	clampMireds := func(v float64) float64 {
+		if maxMireds > minMireds && minMireds > 0 {
+			return math.Min(math.Max(v, float64(minMireds)), float64(maxMireds))
+		}
+		return v
+	}
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.LightStateResponse)
+		if ok {
+			k.On.SetValue(msg.State)
+
+			if supportsBrightness {
+				brightness.SetValue(int(math.Round(float64(msg.Brightness) * 100)))
+			}
+
+			if supportsRGB && hasCapability(msg.ColorMode, colorCapabilityRGB) {
+				h, s := rgbToHS(float64(msg.Red), float64(msg.Green), float64(msg.Blue))
+				hue.SetValue(h)
+				saturation.SetValue(s)
+			}
+
+			if supportsColorTemperature && msg.ColorTemperature > 0 {
+				colorTemperature.SetValue(int(math.Round(clampMireds(float64(msg.ColorTemperature)))))
+			}
+
+		} else {
+			d.log.Errorf("unexpected state for light : %+v", newState)
+		}
+
+	})
+
+	// homekit -> esphome
+	k.On.OnSetRemoteValue(func(v bool) error {
+		return d.Send(&api.LightCommandRequest{
+			Key:      e.Key,
+			State:    v,
+			HasState: true,
+		})
+	})
+
+	brightness.OnSetRemoteValue(func(v int) error {
+		return d.Send(&api.LightCommandRequest{
+			Key:           e.Key,
+			Brightness:    float32(v) / 100.0,
+			HasBrightness: true,
+		})
+	})
+
+	// sendColor sends hue and saturation as rgb color
+	sendColor := func(h, s float64) error {
+		r, g, b := hsToRGB(h, s)
+		return d.Send(&api.LightCommandRequest{
+			Key:          e.Key,
+			HasColorMode: true,
+			ColorMode:    rgbMode,
+			HasRgb:       true,
+			Red:          float32(r),
+			Green:        float32(g),
+			Blue:         float32(b),
+			// turn off white channels, so the color is not washed out
+			HasWhite:     hasCapability(rgbMode, colorCapabilityWhite),
+			HasColdWhite: hasCapability(rgbMode, colorCapabilityColdWarmWhite),
+			HasWarmWhite: hasCapability(rgbMode, colorCapabilityColdWarmWhite),
+		})
+	}
+
+	// scheduleColor sends the color once hue and saturation are written,
+	// colorTimer is used only by homekit requests and they hold hapMu
+	var colorTimer *time.Timer
+	scheduleColor := func() {
+		if colorTimer != nil {
+			colorTimer.Stop()
+		}
+		colorTimer = time.AfterFunc(colorWriteDelay, func() {
+			d.hapMu.Lock()
+			h, s := hue.Value(), saturation.Value()
+			d.hapMu.Unlock()
+
+			err := sendColor(h, s)
+			if err != nil {
+				d.log.WithError(err).Error("unable to send light color")
+			}
+		})
+	}
+
+	hue.OnSetRemoteValue(func(v float64) error {
+		scheduleColor()
+		return nil
+	})
+
+	saturation.OnSetRemoteValue(func(v float64) error {
+		scheduleColor()
+		return nil
+	})
+
+	colorTemperature.OnSetRemoteValue(func(v int) error {
+		return d.Send(&api.LightCommandRequest{
+			Key:                 e.Key,
+			HasColorMode:        true,
+			ColorMode:           ctMode,
+			HasColorTemperature: true,
+			ColorTemperature:    float32(clampMireds(float64(v))),
+		})
+	})
+
+	sv = k.S
+	return
+}
@@ -0,0 +1,99 @@
+package esphomehomekit
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRGBToHS(t *testing.T) {
+	tests := []struct {
+		r, g, b float64
+		h, s    float64
+	}{
+		{1, 1, 1, 0, 0},
+		{0, 0, 0, 0, 0},
+		{1, 0, 0, 0, 100},
+		{0, 1, 0, 120, 100},
+		{0, 0, 1, 240, 100},
+		{1, 1, 0, 60, 100},
+		{1, 0, 1, 300, 100},
+		{1, 0.5, 0.5, 0, 50},
+	}
+	for _, tt := range tests {
+		h, s := rgbToHS(tt.r, tt.g, tt.b)
+		if math.Abs(h-tt.h) > 1e-9 || math.Abs(s-tt.s) > 1e-9 {
+			t.Errorf("rgbToHS(%v, %v, %v) = %v, %v, want %v, %v", tt.r, tt.g, tt.b, h, s, tt.h, tt.s)
+		}
+	}
+}
+
+func TestHSToRGB(t *testing.T) {
+	tests := []struct {
+		h, s    float64
+		r, g, b float64
+	}{
+		{0, 0, 1, 1, 1},
+		{0, 100, 1, 0, 0},
+		{120, 100, 0, 1, 0},
+		{240, 100, 0, 0, 1},
+		{60, 100, 1, 1, 0},
+		{300, 100, 1, 0, 1},
+		{0, 50, 1, 0.5, 0.5},
+	}
+	for _, tt := range tests {
+		r, g, b := hsToRGB(tt.h, tt.s)
+		if math.Abs(r-tt.r) > 1e-9 || math.Abs(g-tt.g) > 1e-9 || math.Abs(b-tt.b) > 1e-9 {
+			t.Errorf("hsToRGB(%v, %v) = %v, %v, %v, want %v, %v, %v", tt.h, tt.s, r, g, b, tt.r, tt.g, tt.b)
+		}
+	}
+}
+
+func TestHSRoundTrip(t *testing.T) {
+	for h := 0.0; h < 360; h += 15 {
+		for _, s := range []float64{10, 50, 100} {
+			gh, gs := rgbToHS(hsToRGB(h, s))
+			if math.Abs(gh-h) > 1e-6 || math.Abs(gs-s) > 1e-6 {
+				t.Errorf("round trip of %v, %v = %v, %v", h, s, gh, gs)
+			}
+		}
+	}
+}
+
+func TestLightColorSentOnce(t *testing.T) {
+	info := &api.ListEntitiesLightResponse{
+		Key:                 1,
+		SupportedColorModes: []api.ColorMode{api.ColorMode_COLOR_MODE_RGB},
+	}
+
+	d := newTestDevice()
+	d.log.Logger.SetLevel(logrus.ErrorLevel)
+	hook := test.NewLocal(d.log.Logger)
+
+	e := &Entity{Key: 1, ID: "strip", Type: EntityTypeLight, Info: info}
+	sv, err := d.createLightService(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// homekit writes both characteristics in one request,
+	// device is not connected, so every sent command is logged as failed
+	s := &svc{devices: []*device{d}}
+	put := s.lockDevices(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		findC(t, sv, characteristic.TypeHue).SetValueRequest(120.0, r)
+		findC(t, sv, characteristic.TypeSaturation).SetValueRequest(50.0, r)
+	}))
+	put.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/characteristics", nil))
+
+	time.Sleep(4 * colorWriteDelay)
+	if n := len(hook.AllEntries()); n != 1 {
+		t.Errorf("color was sent %d times, want once", n)
+	}
+}
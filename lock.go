@@ -0,0 +1,88 @@
+package esphomehomekit
+
+import (
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+func (d *device) createLockService(e *Entity) (sv *service.S, err error) {
+
+	supportsOpen := false
+	requiresCode := false
+
+	info, ok := e.Info.(*api.ListEntitiesLockResponse)
+	if ok {
+		supportsOpen = info.SupportsOpen
+		requiresCode = info.RequiresCode
+	}
+
+	code := d.entityConfig(e).Code
+	if requiresCode && code == "" {
+		d.warnOnce(e, d.log, "lock %s requires code, but no code is configured", e.ID)
+	}
+
+	// command creates lock request, with code if required
+	command := func(c api.LockCommand) *api.LockCommandRequest {
+		return &api.LockCommandRequest{
+			Key:     e.Key,
+			Command: c,
+			HasCode: requiresCode,
+			Code:    code,
+		}
+	}
+
+	k := service.NewLockMechanism()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	k.LockCurrentState.SetValue(characteristic.LockCurrentStateUnknown)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.LockStateResponse)
+		if ok {
+			switch msg.State {
+			case api.LockState_LOCK_STATE_LOCKED:
+				k.LockCurrentState.SetValue(characteristic.LockCurrentStateSecured)
+				k.LockTargetState.SetValue(characteristic.LockTargetStateSecured)
+			case api.LockState_LOCK_STATE_UNLOCKED:
+				k.LockCurrentState.SetValue(characteristic.LockCurrentStateUnsecured)
+				k.LockTargetState.SetValue(characteristic.LockTargetStateUnsecured)
+			case api.LockState_LOCK_STATE_JAMMED:
+				k.LockCurrentState.SetValue(characteristic.LockCurrentStateJammed)
+			case api.LockState_LOCK_STATE_LOCKING:
+				// current state is kept until the lock is done
+				k.LockTargetState.SetValue(characteristic.LockTargetStateSecured)
+			case api.LockState_LOCK_STATE_UNLOCKING:
+				k.LockTargetState.SetValue(characteristic.LockTargetStateUnsecured)
+			default:
+				k.LockCurrentState.SetValue(characteristic.LockCurrentStateUnknown)
+			}
+		} else {
+			d.log.Errorf("unexpected state for lock : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	k.LockTargetState.OnSetRemoteValue(func(v int) error {
+		if v == characteristic.LockTargetStateSecured {
+			return d.Send(command(api.LockCommand_LOCK_LOCK))
+		}
+		return d.Send(command(api.LockCommand_LOCK_UNLOCK))
+	})
+
+	if supportsOpen {
+		open := d.newMomentarySwitch(e.Name+" Open", time.Second, func() error {
+			return d.Send(command(api.LockCommand_LOCK_OPEN))
+		})
+		k.AddS(open.S)
+	}
+
+	sv = k.S
+	return
+}
@@ -2,180 +2,229 @@ package esphomehomekit
 
 import (
 	"context"
-	"os"
-	"os/signal"
-	"strings"
+	"errors"
+	"fmt"
+	"path"
 	"sync"
-	"syscall"
 	"time"
 
-	esphome "github.com/mycontroller-org/esphome_api/pkg/client"
-	"github.com/mycontroller-org/esphome_api/pkg/model"
 	"github.com/sirupsen/logrus"
-	"github.com/spf13/pflag"
-	"github.com/spf13/viper"
 )
 
+// time to wait for devices before homekit is started
+const startupTimeout = time.Minute
+
+// default directory of homekit storage
+const defaultStorageDir = "./.homekit"
+
+// default name of the bridge accessory
+const defaultBridgeName = "esphome-homekit"
+
+// Options configures the bridge. A single device is set by Name, Address, Password
+// and Entities and it is published as a standalone accessory. When Devices are set,
+// all of them are published behind one bridge accessory called Name.
+type Options struct {
+	Name     string
+	Address  string
+	Password string
+	Entities map[string]EntityOptions
+
+	Devices []DeviceOptions
+
+	// HomeKit pairing pin
+	Pin string
+	// directory where HomeKit keys and pairings are stored ("./.homekit" by default)
+	StorageDir string
+
+	Reconnect ReconnectOptions
+
+	// mappers of own HomeKit services, they are used before the built-in ones
+	// and mappers earlier in the list take priority
+	Mappers []Mapper
+
+	// logger of the bridge (logrus standard logger by default)
+	Logger *logrus.Logger
+}
+
 type ESPHomeService interface {
-	Start() error
+	// Run connects to esphome devices and publishes them to HomeKit,
+	// it blocks until ctx is cancelled, Stop is called or the HomeKit server fails
+	Run(ctx context.Context) error
+	// Stop stops running bridge
+	Stop()
 }
 
 type svc struct {
-	entities          EntryMap
+	opts              Options
+	log               *logrus.Logger
+	devices           []*device
+	bridge            bool
 	name              string
 	homekitPIN        string
 	homekitStorageDir string
-	esphomeInfo       *model.HelloResponse
-	esphomeClient     *esphome.Client
 	ctx               context.Context
-	cancel            context.CancelFunc
 	wg                *sync.WaitGroup
-}
 
-func New() ESPHomeService {
-	return &svc{
-		entities: make(EntryMap),
-	}
-}
+	cancelMu sync.Mutex
+	cancel   context.CancelFunc
 
-func (s *svc) connectToESPHome(subscribeStates bool) (err error) {
+	// running homekit server, restarted when accessories change
+	homekitMu     sync.Mutex
+	homekitCancel context.CancelFunc
+	homekitDone   chan struct{}
+	// errors of the homekit server that stop the bridge
+	homekitErr chan error
+}
 
-	if s.esphomeClient != nil {
-		s.esphomeClient = nil
+func New(opts Options) ESPHomeService {
+	s := &svc{
+		opts:              opts,
+		log:               opts.Logger,
+		name:              opts.Name,
+		homekitPIN:        opts.Pin,
+		homekitStorageDir: opts.StorageDir,
 	}
-
-	address := viper.GetString("address")
-	s.esphomeClient, err = esphome.Init(s.name, address, time.Second*10, s.esphomeHandler)
-	if err != nil {
-		logrus.WithError(err).Error("unable to init client")
-		return
+	if s.log == nil {
+		s.log = logrus.StandardLogger()
 	}
-
-	helloResponse, err := s.esphomeClient.Hello()
-	if err != nil {
-		logrus.WithError(err).Error("no answer from hello")
-		return
+	if s.homekitStorageDir == "" {
+		s.homekitStorageDir = defaultStorageDir
 	}
-	logrus.Debugf("hello response : %v", helloResponse)
+	return s
+}
 
-	password := viper.GetString("password")
-	err = s.esphomeClient.Login(password)
-	if err != nil {
-		logrus.WithError(err).Error("unable to login to client")
-		return
+// createDevices creates devices from options. When no Devices are
+// set, the top level Name, Address, Password and Entities
+// describe a single device, published as a standalone accessory.
+func (s *svc) createDevices() (err error) {
+
+	configs := s.opts.Devices
+	if len(configs) == 0 {
+		configs = []DeviceOptions{{
+			Name:     s.opts.Name,
+			Address:  s.opts.Address,
+			Password: s.opts.Password,
+			Entities: s.opts.Entities,
+		}}
+	} else {
+		s.bridge = true
+		if s.name == "" {
+			s.name = defaultBridgeName
+		}
 	}
 
-	if subscribeStates {
-		err = s.esphomeClient.SubscribeStates()
-		if err != nil {
-			logrus.WithError(err).Error("unable to subscribe for states")
-			s.esphomeClient.Close()
+	s.devices = nil
+	names := make(map[string]bool)
+	ids := make(map[uint64]string)
+	for i, cfg := range configs {
+		if cfg.Name == "" || cfg.Address == "" {
+			return fmt.Errorf("device %d: name and address are required", i)
 		}
-	} else {
-		s.esphomeInfo = helloResponse
+		if names[cfg.Name] {
+			return fmt.Errorf("device %s: duplicate name", cfg.Name)
+		}
+		names[cfg.Name] = true
+		if other, ok := ids[accessoryIDFor(cfg.Name)]; ok {
+			return fmt.Errorf("device %s: accessory id collides with device %s, please rename one of them", cfg.Name, other)
+		}
+		ids[accessoryIDFor(cfg.Name)] = cfg.Name
+		for pattern, ec := range cfg.Entities {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("device %s: invalid entity pattern %q", cfg.Name, pattern)
+			}
+			if ec.Type != "" && !validEntityType(ec.Type) {
+				return fmt.Errorf("device %s: entity %s: unknown type %q", cfg.Name, pattern, ec.Type)
+			}
+		}
+		s.devices = append(s.devices, newDevice(cfg, s.opts.Reconnect, s.opts.Mappers, s.log))
 	}
-
 	return
 }
 
-func (s *svc) Start() (err error) {
-
-	viper.SetDefault("log_level", "warning")
-	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
-	viper.AutomaticEnv()
-	pflag.String("log_level", "warning", "Log level")
-
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	pflag.Parse()
-	viper.BindPFlags(pflag.CommandLine)
+func (s *svc) Run(ctx context.Context) (err error) {
 
-	err = viper.ReadInConfig()
-	if err != nil {
-		logrus.WithError(err).Fatal("unable to read config")
+	s.cancelMu.Lock()
+	if s.cancel != nil {
+		s.cancelMu.Unlock()
+		return errors.New("bridge is already running")
 	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.cancelMu.Unlock()
+
+	defer func() {
+		s.cancelMu.Lock()
+		s.cancel()
+		s.cancel = nil
+		s.cancelMu.Unlock()
+	}()
 
-	customFormatter := new(logrus.TextFormatter)
-	customFormatter.TimestampFormat = "2006-01-02 15:04:05"
-	customFormatter.FullTimestamp = true
-	customFormatter.ForceColors = true
-	logrus.SetFormatter(customFormatter)
-
-	logLevel, err := logrus.ParseLevel(viper.GetString("log_level"))
+	err = s.createDevices()
 	if err != nil {
-		logrus.WithError(err).Errorf("wrong log_level text : %s", viper.GetString("log_level"))
+		return fmt.Errorf("invalid devices config: %w", err)
 	}
-	logrus.WithField("log_level", logLevel).Print("Log level set")
-	logrus.SetLevel(logLevel)
-
-	s.name = viper.GetString("name")
-	s.homekitPIN = viper.GetString("homekit.pin")
-	s.homekitStorageDir = viper.GetString("homekit.storage_dir")
-	if s.homekitStorageDir == "" {
-		s.homekitStorageDir = "./.homekit"
-	}
-
-	// Setup a listener for interrupts and SIGTERM signals
-	// to stop the server.
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	s.wg = new(sync.WaitGroup)
+	s.homekitErr = make(chan error, 1)
+
+	// devices are connected by their supervisors, homekit is started when all of them
+	// have listed entities or failed to connect. Devices that are not listed yet
+	// are published without services and rebuilt when they list their entities.
+	ready := make([]chan struct{}, len(s.devices))
+	for i, d := range s.devices {
+		ready[i] = make(chan struct{})
+		d.watchConnection(readyOnce(ready[i]))
+		d.onEntitiesChanged = s.rebuildHomeKit
+
+		s.wg.Add(1)
+		go d.supervise(s.ctx, s.wg)
+	}
 
-	s.ctx, s.cancel = context.WithCancel(context.Background())
-
-	err = s.connectToESPHome(false)
-	if err != nil {
-		logrus.WithError(err).Error("unable to connect to esphome")
-		return
+	deadline := time.Now().Add(startupTimeout)
+	for i, d := range s.devices {
+		select {
+		case <-ready[i]:
+		case <-time.After(time.Until(deadline)):
+			d.log.Warn("device is not connected yet, publishing it without entities")
+		case <-s.ctx.Done():
+			s.wg.Wait()
+			return
+		}
 	}
-	defer s.esphomeClient.Close()
 
-	err = s.esphomeClient.ListEntities()
+	err = s.initializeHomeKit(s.ctx)
 	if err != nil {
-		logrus.WithError(err).Error("error when listing entries")
-		return
+		s.cancel()
+		s.wg.Wait()
+		return fmt.Errorf("unable to initialize homekit: %w", err)
 	}
 
-	pingTicker := time.NewTicker(15 * time.Second)
-	defer pingTicker.Stop()
-
-	go func() {
-		errorCounter := 0
-		for _ = range pingTicker.C {
-
-			if s.esphomeClient != nil {
-				logrus.Debug("pinging esphome")
-				pingError := s.esphomeClient.Ping()
-				if pingError != nil {
-					logrus.WithError(pingError).Errorf("error pinging esphome")
-					errorCounter++
-				} else {
-					errorCounter = 0
-				}
-
-				if errorCounter >= 2 {
-					errorCounter = 0
-					// Try to reconnect
-					logrus.Debug("reconnecting esphome")
-					connectError := s.connectToESPHome(true)
-					if connectError != nil {
-						logrus.WithError(connectError).Errorf("error connecting to esphome")
-					}
-				}
-			}
-
-		}
-	}()
-
-	<-c // block until we got interupt signal
-	// Stop delivering signals.
-	signal.Stop(c)
-	// Cancel the context to stop the server.
-	s.cancel()
+	// block until stopped or the homekit server fails
+	select {
+	case <-s.ctx.Done():
+	case err = <-s.homekitErr:
+		s.cancel()
+	}
 
-	logrus.Debug("shuting down esphome-homekit bridge")
+	s.log.Debug("shuting down esphome-homekit bridge")
 
 	s.wg.Wait()
 	return
 }
+
+// readyOnce returns connection listener that closes ready after the first connect attempt
+func readyOnce(ready chan struct{}) func(connectionEvent) {
+	var once sync.Once
+	return func(ev connectionEvent) {
+		if ev.To != stateConnecting {
+			once.Do(func() { close(ready) })
+		}
+	}
+}
+
+func (s *svc) Stop() {
+	s.cancelMu.Lock()
+	defer s.cancelMu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
@@ -0,0 +1,52 @@
+package esphomehomekit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCreateDevices(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{"single", Options{Name: "light", Address: "light:6053"}, false},
+		{"bridge", Options{Devices: []DeviceOptions{{Name: "a", Address: "a:6053"}, {Name: "b", Address: "b:6053"}}}, false},
+		{"missing address", Options{Name: "light"}, true},
+		{"duplicate name", Options{Devices: []DeviceOptions{{Name: "a", Address: "a:6053"}, {Name: "a", Address: "b:6053"}}}, true},
+		{"invalid pattern", Options{Name: "light", Address: "light:6053", Entities: map[string]EntityOptions{"relay_[": {}}}, true},
+		{"known type", Options{Name: "light", Address: "light:6053", Entities: map[string]EntityOptions{"relay_*": {Type: "outlet"}}}, false},
+		{"unknown type", Options{Name: "light", Address: "light:6053", Entities: map[string]EntityOptions{"relay_*": {Type: "outlt"}}}, true},
+	}
+	for _, tt := range tests {
+		tt.opts.Logger = logrus.New()
+		s := New(tt.opts).(*svc)
+		if err := s.createDevices(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: createDevices() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRunServerError(t *testing.T) {
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	s := New(Options{
+		Name:       "light",
+		Address:    "127.0.0.1:1",
+		Pin:        "123", // rejected by the homekit server
+		StorageDir: t.TempDir(),
+		Logger:     log,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := s.Run(ctx)
+	if err == nil || ctx.Err() != nil {
+		t.Errorf("Run() error = %v, want homekit server error", err)
+	}
+}
@@ -0,0 +1,52 @@
+package esphomehomekit
+
+import (
+	"fmt"
+
+	"github.com/brutella/hap/service"
+	"google.golang.org/protobuf/proto"
+)
+
+// Commander sends commands (e.g. SwitchCommandRequest) to the esphome device of the entity
+type Commander interface {
+	Send(msg proto.Message) error
+}
+
+// Mapper creates homekit service for esphome entities it matches.
+// Build should call SetOnUpdate of the entity to receive its states,
+// linked services of the returned service are published as well.
+// Build may return nil service to skip the entity.
+type Mapper interface {
+	Match(e *Entity) bool
+	Build(e *Entity, c Commander) (*service.S, error)
+}
+
+// builtinMapper maps entities of one kind by its create function. It is created
+// for the device of the entities, which also sends the commands (it is the Commander
+// passed to Build).
+type builtinMapper struct {
+	kind *entityKind
+	d    *device
+}
+
+func (m builtinMapper) Match(e *Entity) bool {
+	return e.Type == m.kind.Type
+}
+
+func (m builtinMapper) Build(e *Entity, c Commander) (*service.S, error) {
+	if t := m.d.entityConfig(e).Type; t != "" && !m.kind.acceptsType(t) {
+		return nil, fmt.Errorf("entity %s: type %q is not supported for this kind of entity", e.ID, t)
+	}
+	return m.kind.create(m.d, e)
+}
+
+// newMappers returns given mappers followed by the built-in ones of the device
+func (d *device) newMappers(ms []Mapper) []Mapper {
+	ms = append([]Mapper{}, ms...)
+	for _, t := range entityTypes {
+		if kind := entityKinds[t]; kind.create != nil {
+			ms = append(ms, builtinMapper{kind: kind, d: d})
+		}
+	}
+	return ms
+}
@@ -0,0 +1,46 @@
+package esphomehomekit
+
+import (
+	"testing"
+
+	"github.com/brutella/hap/service"
+	"github.com/sirupsen/logrus"
+)
+
+type valveMapper struct{}
+
+func (valveMapper) Match(e *Entity) bool {
+	return e.Type == EntityTypeSwitch && e.ID == "valve"
+}
+
+func (valveMapper) Build(e *Entity, c Commander) (*service.S, error) {
+	return service.NewValve().S, nil
+}
+
+func TestMappers(t *testing.T) {
+	s := New(Options{
+		Name:    "garden",
+		Address: "garden:6053",
+		Mappers: []Mapper{valveMapper{}},
+		Logger:  logrus.New(),
+	}).(*svc)
+	if err := s.createDevices(); err != nil {
+		t.Fatal(err)
+	}
+	d := s.devices[0]
+
+	tests := map[string]string{
+		"valve": service.TypeValve,
+		"relay": service.TypeSwitch,
+	}
+	for id, want := range tests {
+		sv, err := d.createService(switchEntity(1, id))
+		if err != nil || sv == nil {
+			t.Errorf("%s: service is not created (%v)", id, err)
+			continue
+		}
+		if sv.Type != want {
+			t.Errorf("%s: service type = %s, want %s", id, sv.Type, want)
+		}
+	}
+}
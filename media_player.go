@@ -0,0 +1,111 @@
+package esphomehomekit
+
+import (
+	"math"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+// smart speaker service is not defined by hap library
+const typeSmartSpeaker = "228"
+
+func (d *device) createMediaPlayerService(e *Entity) (sv *service.S, err error) {
+
+	supportsPause := false
+
+	info, ok := e.Info.(*api.ListEntitiesMediaPlayerResponse)
+	if ok {
+		supportsPause = info.SupportsPause
+	}
+
+	// smart speaker adds play/pause control to the speaker
+	k := service.NewSpeaker()
+	if supportsPause {
+		k.Type = typeSmartSpeaker
+	}
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	volume := characteristic.NewVolume()
+	k.AddC(volume.C)
+
+	currentState := characteristic.NewCurrentMediaState()
+	targetState := characteristic.NewTargetMediaState()
+	if supportsPause {
+		currentState.SetValue(characteristic.CurrentMediaStateUnknown)
+		k.AddC(currentState.C)
+		k.AddC(targetState.C)
+	}
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.MediaPlayerStateResponse)
+		if ok {
+			k.Mute.SetValue(msg.Muted)
+			volume.SetValue(int(math.Round(float64(msg.Volume) * 100)))
+
+			if supportsPause {
+				switch msg.State {
+				case api.MediaPlayerState_MEDIA_PLAYER_STATE_PLAYING:
+					currentState.SetValue(characteristic.CurrentMediaStatePlay)
+					targetState.SetValue(characteristic.TargetMediaStatePlay)
+				case api.MediaPlayerState_MEDIA_PLAYER_STATE_PAUSED:
+					currentState.SetValue(characteristic.CurrentMediaStatePause)
+					targetState.SetValue(characteristic.TargetMediaStatePause)
+				case api.MediaPlayerState_MEDIA_PLAYER_STATE_IDLE:
+					currentState.SetValue(characteristic.CurrentMediaStateStop)
+					targetState.SetValue(characteristic.TargetMediaStateStop)
+				default:
+					currentState.SetValue(characteristic.CurrentMediaStateUnknown)
+				}
+			}
+		} else {
+			d.log.Errorf("unexpected state for media player : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	k.Mute.OnSetRemoteValue(func(v bool) error {
+		command := api.MediaPlayerCommand_MEDIA_PLAYER_COMMAND_UNMUTE
+		if v {
+			command = api.MediaPlayerCommand_MEDIA_PLAYER_COMMAND_MUTE
+		}
+
+		return d.Send(&api.MediaPlayerCommandRequest{
+			Key:        e.Key,
+			HasCommand: true,
+			Command:    command,
+		})
+	})
+
+	volume.OnSetRemoteValue(func(v int) error {
+		return d.Send(&api.MediaPlayerCommandRequest{
+			Key:       e.Key,
+			HasVolume: true,
+			Volume:    float32(v) / 100.0,
+		})
+	})
+
+	targetState.OnSetRemoteValue(func(v int) error {
+		command := api.MediaPlayerCommand_MEDIA_PLAYER_COMMAND_PLAY
+		switch v {
+		case characteristic.TargetMediaStatePause:
+			command = api.MediaPlayerCommand_MEDIA_PLAYER_COMMAND_PAUSE
+		case characteristic.TargetMediaStateStop:
+			command = api.MediaPlayerCommand_MEDIA_PLAYER_COMMAND_STOP
+		}
+
+		return d.Send(&api.MediaPlayerCommandRequest{
+			Key:        e.Key,
+			HasCommand: true,
+			Command:    command,
+		})
+	})
+
+	sv = k.S
+	return
+}
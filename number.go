@@ -0,0 +1,219 @@
+package esphomehomekit
+
+import (
+	"math"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+// custom service and characteristic for numbers (visible in third party apps, like Eve)
+const (
+	typeNumberService = "4A0E6F2B-6C4B-4E1A-9E62-2C2A5B5E0000"
+	typeNumberValue   = "4A0E6F2B-6C4B-4E1A-9E62-2C2A5B5E0001"
+)
+
+// numberRange converts between esphome number value and homekit percentage
+type numberRange struct {
+	min, max, step float64
+}
+
+func (r numberRange) percentage(v float64) float64 {
+	if r.max <= r.min {
+		return 0
+	}
+	p := (v - r.min) / (r.max - r.min) * 100
+	return math.Min(math.Max(p, 0), 100)
+}
+
+func (r numberRange) value(percentage float64) float64 {
+	v := r.min + percentage/100*(r.max-r.min)
+	if r.step > 0 {
+		v = r.min + math.Round((v-r.min)/r.step)*r.step
+	}
+	return math.Min(math.Max(v, r.min), r.max)
+}
+
+// hapUnit returns homekit unit for esphome unit of measurement,
+// units unknown to homekit are left unset (controllers reject them)
+func hapUnit(unit string) string {
+	switch unit {
+	case "°C":
+		return characteristic.UnitCelsius
+	case "%":
+		return characteristic.UnitPercentage
+	case "°":
+		return characteristic.UnitArcDegrees
+	case "lx":
+		return characteristic.UnitLux
+	case "s":
+		return characteristic.UnitSeconds
+	}
+	return ""
+}
+
+func (d *device) createNumberService(e *Entity) (sv *service.S, err error) {
+
+	info, ok := e.Info.(*api.ListEntitiesNumberResponse)
+	if !ok {
+		return
+	}
+
+	r := numberRange{
+		min:  float64(info.MinValue),
+		max:  float64(info.MaxValue),
+		step: float64(info.Step),
+	}
+
+	switch d.entityConfig(e).Type {
+	case "fan":
+		return d.createNumberFanService(e, r)
+	case "custom":
+		return d.createNumberCustomService(e, info, r)
+	}
+	return d.createNumberLightService(e, r)
+}
+
+// sendNumber sends new number value to esphome
+func (d *device) sendNumber(e *Entity, v float64) error {
+	return d.Send(&api.NumberCommandRequest{
+		Key:   e.Key,
+		State: float32(v),
+	})
+}
+
+// createNumberLightService maps number to lightbulb brightness, minimal value is reported as off
+func (d *device) createNumberLightService(e *Entity, r numberRange) (sv *service.S, err error) {
+
+	k := service.NewLightbulb()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	brightness := characteristic.NewBrightness()
+	k.AddC(brightness.C)
+
+	// value to restore when turned on
+	last := r.max
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.NumberStateResponse)
+		if ok {
+			v := float64(msg.State)
+			k.On.SetValue(v > r.min)
+			if v > r.min {
+				last = v
+				brightness.SetValue(int(math.Round(r.percentage(v))))
+			}
+		} else {
+			d.log.Errorf("unexpected state for number : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	k.On.OnSetRemoteValue(func(v bool) error {
+		if v {
+			return d.sendNumber(e, last)
+		}
+		return d.sendNumber(e, r.min)
+	})
+
+	brightness.OnSetRemoteValue(func(v int) error {
+		return d.sendNumber(e, r.value(float64(v)))
+	})
+
+	sv = k.S
+	return
+}
+
+// createNumberFanService maps number to fan rotation speed, minimal value is reported as inactive
+func (d *device) createNumberFanService(e *Entity, r numberRange) (sv *service.S, err error) {
+
+	k := service.NewFanV2()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	speed := characteristic.NewRotationSpeed()
+	k.AddC(speed.C)
+
+	// value to restore when activated
+	last := r.max
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.NumberStateResponse)
+		if ok {
+			v := float64(msg.State)
+			if v > r.min {
+				last = v
+				k.Active.SetValue(characteristic.ActiveActive)
+				speed.SetValue(r.percentage(v))
+			} else {
+				k.Active.SetValue(characteristic.ActiveInactive)
+			}
+		} else {
+			d.log.Errorf("unexpected state for number : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	k.Active.OnSetRemoteValue(func(v int) error {
+		if v == characteristic.ActiveActive {
+			return d.sendNumber(e, last)
+		}
+		return d.sendNumber(e, r.min)
+	})
+
+	speed.OnSetRemoteValue(func(v float64) error {
+		return d.sendNumber(e, r.value(v))
+	})
+
+	sv = k.S
+	return
+}
+
+// createNumberCustomService publishes number in its own range as custom characteristic
+func (d *device) createNumberCustomService(e *Entity, info *api.ListEntitiesNumberResponse, r numberRange) (sv *service.S, err error) {
+
+	k := service.New(typeNumberService)
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	value := characteristic.NewFloat(typeNumberValue)
+	value.Format = characteristic.FormatFloat
+	value.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionWrite, characteristic.PermissionEvents}
+	value.Description = e.Name
+	value.SetMinValue(r.min)
+	value.SetMaxValue(r.max)
+	if r.step > 0 {
+		value.SetStepValue(r.step)
+	}
+	value.SetValue(r.min)
+	value.Unit = hapUnit(info.UnitOfMeasurement)
+	k.AddC(value.C)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.NumberStateResponse)
+		if ok {
+			value.SetValue(float64(msg.State))
+		} else {
+			d.log.Errorf("unexpected state for number : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	value.OnSetRemoteValue(func(v float64) error {
+		return d.sendNumber(e, v)
+	})
+
+	sv = k
+	return
+}
@@ -0,0 +1,70 @@
+package esphomehomekit
+
+import (
+	"math"
+	"testing"
+
+	"github.com/brutella/hap/characteristic"
+)
+
+func TestNumberRangeValue(t *testing.T) {
+	tests := []struct {
+		r          numberRange
+		percentage float64
+		want       float64
+	}{
+		{numberRange{0, 100, 1}, 0, 0},
+		{numberRange{0, 100, 1}, 100, 100},
+		{numberRange{0, 100, 1}, 42.4, 42},
+		{numberRange{10, 30, 0.5}, 50, 20},
+		{numberRange{10, 30, 0.5}, 52, 20.5},
+		{numberRange{10, 30, 5}, 60, 20},
+		{numberRange{10, 30, 0}, 25, 15},
+		{numberRange{-20, 20, 1}, 25, -10},
+		{numberRange{0, 100, 1}, 120, 100},
+		{numberRange{0, 100, 1}, -5, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.r.value(tt.percentage); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%+v.value(%v) = %v, want %v", tt.r, tt.percentage, got, tt.want)
+		}
+	}
+}
+
+func TestNumberRangePercentage(t *testing.T) {
+	tests := []struct {
+		r    numberRange
+		v    float64
+		want float64
+	}{
+		{numberRange{0, 100, 1}, 42, 42},
+		{numberRange{10, 30, 1}, 20, 50},
+		{numberRange{10, 30, 1}, 5, 0},
+		{numberRange{10, 30, 1}, 35, 100},
+		{numberRange{10, 10, 1}, 10, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.r.percentage(tt.v); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%+v.percentage(%v) = %v, want %v", tt.r, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestHAPUnit(t *testing.T) {
+	tests := map[string]string{
+		"°C":  characteristic.UnitCelsius,
+		"%":   characteristic.UnitPercentage,
+		"°":   characteristic.UnitArcDegrees,
+		"lx":  characteristic.UnitLux,
+		"s":   characteristic.UnitSeconds,
+		"°F":  "",
+		"W":   "",
+		"":    "",
+		"min": "",
+	}
+	for unit, want := range tests {
+		if got := hapUnit(unit); got != want {
+			t.Errorf("hapUnit(%q) = %q, want %q", unit, got, want)
+		}
+	}
+}
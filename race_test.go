@@ -0,0 +1,123 @@
+package esphomehomekit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+	"google.golang.org/protobuf/proto"
+)
+
+// number of states and writes sent by every goroutine of race tests
+const raceIterations = 1000
+
+// findC returns characteristic of given type of the service
+func findC(t *testing.T, s *service.S, typ string) *characteristic.C {
+	t.Helper()
+	for _, c := range s.Cs {
+		if c.Type == typ {
+			return c
+		}
+	}
+	t.Fatalf("service %s has no characteristic %s", s.Type, typ)
+	return nil
+}
+
+// flood sends esphome states to the device while homekit writes value to the characteristic,
+// both go the same way as in the running bridge (device is not connected, so commands fail)
+func flood(d *device, e *Entity, c *characteristic.C, state func(i int) proto.Message, value interface{}) {
+	d.currentEntities().add(e)
+
+	s := &svc{devices: []*device{d}}
+	put := s.lockDevices(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.SetValueRequest(value, r)
+	}))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < raceIterations; i++ {
+			d.esphomeHandler(state(i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < raceIterations; i++ {
+			put.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/characteristics", nil))
+		}
+	}()
+	wg.Wait()
+}
+
+func TestRaceNumber(t *testing.T) {
+	r := numberRange{min: 0, max: 100, step: 1}
+	state := func(i int) proto.Message {
+		return &api.NumberStateResponse{Key: 1, State: float32(i % 100)}
+	}
+
+	d := newTestDevice()
+	e := &Entity{Key: 1, ID: "light", Type: EntityTypeNumber}
+	sv, err := d.createNumberLightService(e, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flood(d, e, findC(t, sv, characteristic.TypeOn), state, true)
+
+	d = newTestDevice()
+	e = &Entity{Key: 1, ID: "fan", Type: EntityTypeNumber}
+	sv, err = d.createNumberFanService(e, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flood(d, e, findC(t, sv, characteristic.TypeActive), state, characteristic.ActiveActive)
+}
+
+func TestRaceClimate(t *testing.T) {
+	info := &api.ListEntitiesClimateResponse{
+		Key:            1,
+		SupportedModes: []api.ClimateMode{api.ClimateMode_CLIMATE_MODE_OFF, api.ClimateMode_CLIMATE_MODE_HEAT, api.ClimateMode_CLIMATE_MODE_COOL},
+		SupportedFanModes: []api.ClimateFanMode{
+			api.ClimateFanMode_CLIMATE_FAN_LOW, api.ClimateFanMode_CLIMATE_FAN_HIGH,
+		},
+	}
+	state := func(i int) proto.Message {
+		modes := []api.ClimateMode{api.ClimateMode_CLIMATE_MODE_HEAT, api.ClimateMode_CLIMATE_MODE_COOL}
+		fans := []api.ClimateFanMode{api.ClimateFanMode_CLIMATE_FAN_LOW, api.ClimateFanMode_CLIMATE_FAN_HIGH}
+		return &api.ClimateStateResponse{Key: 1, Mode: modes[i%2], FanMode: fans[i%2]}
+	}
+
+	d := newTestDevice()
+	e := &Entity{Key: 1, ID: "ac", Type: EntityTypeClimate, Info: info}
+	sv, err := d.createHeaterCoolerService(e, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flood(d, e, findC(t, sv, characteristic.TypeActive), state, characteristic.ActiveActive)
+
+	fan := d.createClimateFanService(e, info)
+	if fan == nil {
+		t.Fatal("climate fan service was not created")
+	}
+	flood(d, e, findC(t, fan, characteristic.TypeActive), state, characteristic.ActiveActive)
+}
+
+func TestRaceCover(t *testing.T) {
+	info := &api.ListEntitiesCoverResponse{Key: 1, SupportsPosition: true}
+	state := func(i int) proto.Message {
+		return &api.CoverStateResponse{Key: 1, Position: float32(i%100) / 100}
+	}
+
+	d := newTestDevice()
+	e := &Entity{Key: 1, ID: "blind", Type: EntityTypeCover, Info: info}
+	sv, err := d.createCoverService(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flood(d, e, findC(t, sv, characteristic.TypeTargetPosition), state, 50)
+	flood(d, e, findC(t, sv, characteristic.TypeHoldPosition), state, true)
+}
@@ -0,0 +1,209 @@
+package esphomehomekit
+
+import (
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Entity is an esphome entity, Info holds its ListEntities...Response message
+// and ID its object id
+type Entity struct {
+	Key  uint32
+	ID   string
+	Name string
+	Type EntityType
+	Info interface{}
+
+	mu        sync.Mutex
+	lastState proto.Message
+	missing   bool // esphome has no state for the entity
+	onUpdate  func(newState interface{})
+	watchers  []func(newState interface{})
+}
+
+// SetOnUpdate sets fn to be called with new states by the entity's own service
+func (e *Entity) SetOnUpdate(fn func(newState interface{})) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onUpdate = fn
+}
+
+// watch registers fn to be called on every state update of the entity,
+// in addition to the function set by SetOnUpdate
+func (e *Entity) watch(fn func(newState interface{})) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.watchers = append(e.watchers, fn)
+}
+
+// reset removes all update callbacks, services of the previous accessory
+// must not receive updates when the accessory is created again
+func (e *Entity) reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onUpdate = nil
+	e.watchers = nil
+}
+
+// update passes new state to the service of the entity, missing state
+// is not passed (the service is reported as faulted instead)
+func (e *Entity) update(newState proto.Message) {
+	missing := false
+	if msg, ok := newState.(interface{ GetMissingState() bool }); ok {
+		missing = msg.GetMissingState()
+	}
+
+	e.mu.Lock()
+	e.lastState = newState
+	e.missing = missing
+	onUpdate := e.onUpdate
+	watchers := append([]func(newState interface{}){}, e.watchers...)
+	e.mu.Unlock()
+
+	if onUpdate != nil && !missing {
+		onUpdate(newState)
+	}
+	for _, fn := range watchers {
+		fn(newState)
+	}
+}
+
+// State returns the last state received from esphome, nil if there was none
+func (e *Entity) State() proto.Message {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lastState
+}
+
+// Missing reports whether esphome has no state for the entity
+func (e *Entity) Missing() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.missing
+}
+
+// registry is a concurrency safe store of device entities
+type registry struct {
+	mu          sync.RWMutex
+	entities    map[uint32]*Entity
+	subscribers map[int]func(e *Entity)
+	nextID      int
+}
+
+func newRegistry() *registry {
+	return &registry{
+		entities:    make(map[uint32]*Entity),
+		subscribers: make(map[int]func(e *Entity)),
+	}
+}
+
+// add adds the entity, an entity with the same key is replaced
+func (r *registry) add(e *Entity) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entities[e.Key] = e
+}
+
+// get returns the entity with given esphome key
+func (r *registry) get(key uint32) (*Entity, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.entities[key]
+	return e, ok
+}
+
+// byID returns the entity with given esphome object id
+func (r *registry) byID(id string) *Entity {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, e := range r.entities {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+func (r *registry) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.entities)
+}
+
+// snapshot returns all entities sorted by esphome key,
+// entities added later are not included
+func (r *registry) snapshot() []*Entity {
+	r.mu.RLock()
+	entities := make([]*Entity, 0, len(r.entities))
+	for _, e := range r.entities {
+		entities = append(entities, e)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].Key < entities[j].Key
+	})
+	return entities
+}
+
+// update passes new state to the entity with given key and notifies subscribers,
+// it returns false for unknown keys
+func (r *registry) update(key uint32, newState proto.Message) bool {
+	e, ok := r.get(key)
+	if !ok {
+		return false
+	}
+
+	e.update(newState)
+
+	r.mu.RLock()
+	subscribers := make([]func(e *Entity), 0, len(r.subscribers))
+	for _, fn := range r.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	r.mu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(e)
+	}
+	return true
+}
+
+// subscribe registers fn to be called after state of any entity changes,
+// the returned function cancels the subscription
+func (r *registry) subscribe(fn func(e *Entity)) (cancel func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := r.nextID
+	r.nextID++
+	r.subscribers[id] = fn
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.subscribers, id)
+	}
+}
+
+// equal reports whether both registries contain the same entities (compared by their esphome info)
+func (r *registry) equal(other *registry) bool {
+	a := r.snapshot()
+	b := other.snapshot()
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || a[i].Type != b[i].Type {
+			return false
+		}
+		ai, aok := a[i].Info.(proto.Message)
+		bi, bok := b[i].Info.(proto.Message)
+		if !aok || !bok || !proto.Equal(ai, bi) {
+			return false
+		}
+	}
+	return true
+}
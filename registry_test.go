@@ -0,0 +1,53 @@
+package esphomehomekit
+
+import (
+	"testing"
+
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+func newTestRegistry(entities ...*Entity) *registry {
+	r := newRegistry()
+	for _, e := range entities {
+		r.add(e)
+	}
+	return r
+}
+
+func switchEntity(key uint32, id string) *Entity {
+	return &Entity{
+		Key:  key,
+		ID:   id,
+		Type: EntityTypeSwitch,
+		Info: &api.ListEntitiesSwitchResponse{Key: key, ObjectId: id, Name: id},
+	}
+}
+
+func TestRegistryEqual(t *testing.T) {
+	renamed := switchEntity(1, "relay")
+	renamed.Info.(*api.ListEntitiesSwitchResponse).Name = "Relay"
+
+	otherType := switchEntity(1, "relay")
+	otherType.Type = EntityTypeLight
+
+	tests := []struct {
+		name string
+		a, b *registry
+		want bool
+	}{
+		{"empty", newTestRegistry(), newTestRegistry(), true},
+		{"same", newTestRegistry(switchEntity(1, "relay"), switchEntity(2, "light")), newTestRegistry(switchEntity(2, "light"), switchEntity(1, "relay")), true},
+		{"added", newTestRegistry(switchEntity(1, "relay")), newTestRegistry(switchEntity(1, "relay"), switchEntity(2, "light")), false},
+		{"other key", newTestRegistry(switchEntity(1, "relay")), newTestRegistry(switchEntity(2, "relay")), false},
+		{"renamed", newTestRegistry(switchEntity(1, "relay")), newTestRegistry(renamed), false},
+		{"other type", newTestRegistry(switchEntity(1, "relay")), newTestRegistry(otherType), false},
+	}
+	for _, tt := range tests {
+		if got := tt.a.equal(tt.b); got != tt.want {
+			t.Errorf("%s: equal = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := tt.b.equal(tt.a); got != tt.want {
+			t.Errorf("%s: reversed equal = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
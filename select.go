@@ -0,0 +1,145 @@
+package esphomehomekit
+
+import (
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+func (d *device) createSelectService(e *Entity) (sv *service.S, err error) {
+
+	info, ok := e.Info.(*api.ListEntitiesSelectResponse)
+	if !ok || len(info.Options) == 0 {
+		return
+	}
+
+	if d.entityConfig(e).Type == "switches" {
+		return d.createSelectSwitchesService(e, info.Options)
+	}
+
+	// television is published by an accessory of its own (see ownAccessoryTypes),
+	// so it is the only primary service there
+	k := service.NewTelevision()
+	k.Primary = true
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	k.ConfiguredName.SetValue(e.Name)
+	k.SleepDiscoveryMode.SetValue(characteristic.SleepDiscoveryModeAlwaysDiscoverable)
+	// select has no power state
+	k.Active.SetValue(characteristic.ActiveActive)
+
+	// input source identifiers are option index + 1
+	for i, option := range info.Options {
+		input := service.NewInputSource()
+
+		inputName := characteristic.NewName()
+		inputName.SetValue(option)
+		input.AddC(inputName.C)
+
+		id := characteristic.NewIdentifier()
+		id.SetValue(i + 1)
+		input.AddC(id.C)
+
+		input.ConfiguredName.SetValue(option)
+		input.InputSourceType.SetValue(characteristic.InputSourceTypeOther)
+		input.IsConfigured.SetValue(characteristic.IsConfiguredConfigured)
+		input.CurrentVisibilityState.SetValue(characteristic.CurrentVisibilityStateShown)
+
+		k.AddS(input.S)
+	}
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.SelectStateResponse)
+		if ok {
+			for i, option := range info.Options {
+				if option == msg.State {
+					k.ActiveIdentifier.SetValue(i + 1)
+				}
+			}
+		} else {
+			d.log.Errorf("unexpected state for select : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	k.ActiveIdentifier.OnSetRemoteValue(func(v int) error {
+		if v < 1 || v > len(info.Options) {
+			return nil
+		}
+
+		return d.Send(&api.SelectCommandRequest{
+			Key:   e.Key,
+			State: info.Options[v-1],
+		})
+	})
+
+	k.Active.OnSetRemoteValue(func(v int) error {
+		// nothing to turn off
+		return nil
+	})
+
+	sv = k.S
+	return
+}
+
+// createSelectSwitchesService creates mutually exclusive switch for every option of the select.
+// First switch is returned, other switches are linked to it.
+func (d *device) createSelectSwitchesService(e *Entity, options []string) (sv *service.S, err error) {
+
+	current := ""
+	switches := make([]*service.Switch, len(options))
+
+	for i, option := range options {
+		option := option
+
+		k := service.NewSwitch()
+
+		name := characteristic.NewName()
+		name.SetValue(e.Name + " " + option)
+		k.AddC(name.C)
+
+		// homekit -> esphome
+		k.On.OnSetRemoteValue(func(v bool) error {
+			if !v {
+				return nil
+			}
+
+			return d.Send(&api.SelectCommandRequest{
+				Key:   e.Key,
+				State: option,
+			})
+		})
+		k.On.OnValueRemoteUpdate(func(v bool) {
+			if !v && option == current {
+				// selected option can not be turned off, only another one selected
+				k.On.SetValue(true)
+			}
+		})
+
+		switches[i] = k
+		if i == 0 {
+			sv = k.S
+		} else {
+			sv.AddS(k.S)
+		}
+	}
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.SelectStateResponse)
+		if ok {
+			current = msg.State
+			for i, option := range options {
+				switches[i].On.SetValue(option == msg.State)
+			}
+		} else {
+			d.log.Errorf("unexpected state for select : %+v", newState)
+		}
+	})
+
+	return
+}
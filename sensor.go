@@ -0,0 +1,166 @@
+package esphomehomekit
+
+import (
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+// default co2 level (ppm) above which co2 is reported as abnormal
+const carbonDioxideThreshold = 1000
+
+// battery level (%) below which battery is reported as low
+const lowBatteryLevel = 20
+
+// airQualityLimits are upper density limits (µg/m³) for excellent, good, fair and inferior
+// air quality, above the last limit air quality is poor
+var airQualityLimits = map[string][4]float64{
+	"pm25":                       {12, 35, 55, 150},
+	"pm10":                       {54, 154, 254, 354},
+	"volatile_organic_compounds": {300, 500, 1000, 3000},
+	"nitrogen_dioxide":           {40, 100, 200, 400},
+}
+
+// airQuality derives homekit air quality level from density
+func airQuality(deviceClass string, density float64) int {
+	limits, ok := airQualityLimits[deviceClass]
+	if !ok {
+		return characteristic.AirQualityUnknown
+	}
+	for i, limit := range limits {
+		if density <= limit {
+			return characteristic.AirQualityExcellent + i
+		}
+	}
+	return characteristic.AirQualityPoor
+}
+
+func (d *device) createLightSensorService(e *Entity) (sv *service.S, err error) {
+
+	k := service.NewLightSensor()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.SensorStateResponse)
+		if ok {
+			k.CurrentAmbientLightLevel.SetValue(float64(msg.State))
+		} else {
+			d.log.Errorf("unexpected state for sensor : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	// nothing here, as homekit can not trigger this event
+	sv = k.S
+	return
+}
+
+func (d *device) createCarbonDioxideService(e *Entity) (sv *service.S, err error) {
+
+	threshold := d.entityConfig(e).Threshold
+	if threshold <= 0 {
+		threshold = carbonDioxideThreshold
+	}
+
+	k := service.NewCarbonDioxideSensor()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	level := characteristic.NewCarbonDioxideLevel()
+	k.AddC(level.C)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.SensorStateResponse)
+		if ok {
+			level.SetValue(float64(msg.State))
+			if float64(msg.State) > threshold {
+				k.CarbonDioxideDetected.SetValue(characteristic.CarbonDioxideDetectedCO2LevelsAbnormal)
+			} else {
+				k.CarbonDioxideDetected.SetValue(characteristic.CarbonDioxideDetectedCO2LevelsNormal)
+			}
+		} else {
+			d.log.Errorf("unexpected state for sensor : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	// nothing here, as homekit can not trigger this event
+	sv = k.S
+	return
+}
+
+func (d *device) createAirQualityService(e *Entity, deviceClass string) (sv *service.S, err error) {
+
+	k := service.NewAirQualitySensor()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	var density *characteristic.Float
+	switch deviceClass {
+	case "pm25":
+		density = characteristic.NewPM2_5Density().Float
+	case "pm10":
+		density = characteristic.NewPM10Density().Float
+	case "volatile_organic_compounds":
+		density = characteristic.NewVOCDensity().Float
+	case "nitrogen_dioxide":
+		density = characteristic.NewNitrogenDioxideDensity().Float
+	}
+	k.AddC(density.C)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.SensorStateResponse)
+		if ok {
+			density.SetValue(float64(msg.State))
+			k.AirQuality.SetValue(airQuality(deviceClass, float64(msg.State)))
+		} else {
+			d.log.Errorf("unexpected state for sensor : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	// nothing here, as homekit can not trigger this event
+	sv = k.S
+	return
+}
+
+func (d *device) createBatteryService(e *Entity) (sv *service.S, err error) {
+
+	k := service.NewBatteryService()
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	k.ChargingState.SetValue(characteristic.ChargingStateNotChargeable)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.SensorStateResponse)
+		if ok {
+			k.BatteryLevel.SetValue(int(msg.State))
+			if msg.State < lowBatteryLevel {
+				k.StatusLowBattery.SetValue(characteristic.StatusLowBatteryBatteryLevelLow)
+			} else {
+				k.StatusLowBattery.SetValue(characteristic.StatusLowBatteryBatteryLevelNormal)
+			}
+		} else {
+			d.log.Errorf("unexpected state for sensor : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	// nothing here, as homekit can not trigger this event
+	sv = k.S
+	return
+}
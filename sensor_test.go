@@ -0,0 +1,31 @@
+package esphomehomekit
+
+import (
+	"testing"
+
+	"github.com/brutella/hap/characteristic"
+)
+
+func TestAirQuality(t *testing.T) {
+	tests := []struct {
+		deviceClass string
+		density     float64
+		want        int
+	}{
+		{"pm25", 0, characteristic.AirQualityExcellent},
+		{"pm25", 12, characteristic.AirQualityExcellent},
+		{"pm25", 12.1, characteristic.AirQualityGood},
+		{"pm25", 55, characteristic.AirQualityFair},
+		{"pm25", 100, characteristic.AirQualityInferior},
+		{"pm25", 151, characteristic.AirQualityPoor},
+		{"pm10", 200, characteristic.AirQualityFair},
+		{"volatile_organic_compounds", 5000, characteristic.AirQualityPoor},
+		{"nitrogen_dioxide", 40, characteristic.AirQualityExcellent},
+		{"ozone", 10, characteristic.AirQualityUnknown},
+	}
+	for _, tt := range tests {
+		if got := airQuality(tt.deviceClass, tt.density); got != tt.want {
+			t.Errorf("airQuality(%q, %v) = %d, want %d", tt.deviceClass, tt.density, got, tt.want)
+		}
+	}
+}
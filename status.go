@@ -0,0 +1,111 @@
+package esphomehomekit
+
+import (
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+)
+
+// services that support StatusActive characteristic
+var statusActiveServices = map[string]bool{
+	service.TypeTemperatureSensor:    true,
+	service.TypeHumiditySensor:       true,
+	service.TypeLightSensor:          true,
+	service.TypeContactSensor:        true,
+	service.TypeMotionSensor:         true,
+	service.TypeOccupancySensor:      true,
+	service.TypeLeakSensor:           true,
+	service.TypeSmokeSensor:          true,
+	service.TypeCarbonMonoxideSensor: true,
+	service.TypeCarbonDioxideSensor:  true,
+	service.TypeAirQualitySensor:     true,
+}
+
+// entityService is homekit service created for the entity
+type entityService struct {
+	e      *Entity
+	s      *service.S
+	sid    uint64   // instance id of the service
+	cids   []uint64 // instance ids of service characteristics
+	fault  *characteristic.Int
+	active *characteristic.Bool
+}
+
+// newEntityService adds status characteristics to the service of the entity
+// (characteristics already added by the service are reused)
+func newEntityService(e *Entity, s *service.S) *entityService {
+	es := &entityService{e: e, s: s}
+
+	fault := s.C(characteristic.TypeStatusFault)
+	if fault == nil {
+		fault = characteristic.NewStatusFault().C
+		s.AddC(fault)
+	}
+	es.fault = &characteristic.Int{C: fault}
+
+	if statusActiveServices[s.Type] {
+		active := s.C(characteristic.TypeStatusActive)
+		if active == nil {
+			active = characteristic.NewStatusActive().C
+			s.AddC(active)
+		}
+		es.active = &characteristic.Bool{C: active}
+	}
+	return es
+}
+
+// updateStatus reports the service as faulted while the device is offline
+// or the entity has no state
+func (d *device) updateStatus(es *entityService) {
+	d.mu.Lock()
+	ok := d.online
+	d.mu.Unlock()
+	ok = ok && !es.e.Missing()
+
+	if ok {
+		es.fault.SetValue(characteristic.StatusFaultNoFault)
+	} else {
+		es.fault.SetValue(characteristic.StatusFaultGeneralFault)
+	}
+	if es.active != nil {
+		es.active.SetValue(ok)
+	}
+}
+
+// updateEntityStatus updates status of services of the entity after its state changed
+func (d *device) updateEntityStatus(e *Entity) {
+	for _, es := range d.entityServices() {
+		if es.e == e {
+			d.updateStatus(es)
+		}
+	}
+}
+
+func (d *device) entityServices() []*entityService {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.services
+}
+
+// setOnline updates status of all services when the device connects or disconnects
+func (d *device) setOnline(online bool) {
+	d.mu.Lock()
+	changed := d.online != online
+	d.online = online
+	d.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if online {
+		d.log.Info("device is online")
+	} else {
+		d.log.Warn("device is offline")
+	}
+
+	d.hapMu.Lock()
+	defer d.hapMu.Unlock()
+	for _, es := range d.entityServices() {
+		d.updateStatus(es)
+	}
+}
@@ -0,0 +1,231 @@
+package esphomehomekit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// interval of pings while the device is connected
+const pingInterval = 15 * time.Second
+
+// number of failed pings after which the device is reconnected
+const maxFailedPings = 2
+
+// connectionState is state of the connection to esphome device
+type connectionState int
+
+const (
+	stateConnecting connectionState = iota
+	stateConnected
+	stateBackoff
+	stateStopped
+)
+
+var connectionStateNames = map[connectionState]string{
+	stateConnecting: "connecting",
+	stateConnected:  "connected",
+	stateBackoff:    "backoff",
+	stateStopped:    "stopped",
+}
+
+func (s connectionState) String() string {
+	return connectionStateNames[s]
+}
+
+// connectionEvent describes transition of the connection state
+type connectionEvent struct {
+	Device string
+	From   connectionState
+	To     connectionState
+	Err    error // error that caused the transition, if any
+}
+
+// ReconnectOptions configures delays between reconnect attempts
+type ReconnectOptions struct {
+	InitialDelay time.Duration `mapstructure:"initial_delay"`
+	MaxDelay     time.Duration `mapstructure:"max_delay"`
+	Multiplier   float64       `mapstructure:"multiplier"`
+	// part of the delay that is randomly added or subtracted, 0 turns jitter off
+	// (defaultJitter when not set)
+	Jitter *float64 `mapstructure:"jitter"`
+}
+
+var defaultBackoff = ReconnectOptions{
+	InitialDelay: time.Second,
+	MaxDelay:     5 * time.Minute,
+	Multiplier:   2,
+}
+
+const defaultJitter = 0.2
+
+// withDefaults returns config with default values for options that are not set
+func (b ReconnectOptions) withDefaults() ReconnectOptions {
+	if b.InitialDelay <= 0 {
+		b.InitialDelay = defaultBackoff.InitialDelay
+	}
+	if b.MaxDelay <= 0 {
+		b.MaxDelay = defaultBackoff.MaxDelay
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = defaultBackoff.Multiplier
+	}
+	if b.Jitter == nil || *b.Jitter < 0 || *b.Jitter > 1 {
+		jitter := defaultJitter
+		b.Jitter = &jitter
+	}
+	return b
+}
+
+// jitter returns jitter of the delay, 0 if it is not set
+func (b ReconnectOptions) jitter() float64 {
+	if b.Jitter == nil {
+		return 0
+	}
+	return *b.Jitter
+}
+
+// delay returns time to wait before reconnect attempt (counted from 0),
+// jitter spreads reconnects of devices that went offline at the same time
+func (b ReconnectOptions) delay(attempt int, rnd *rand.Rand) time.Duration {
+	d := float64(b.InitialDelay) * math.Pow(b.Multiplier, float64(attempt))
+	d = math.Min(d, float64(b.MaxDelay))
+	d += d * b.jitter() * (rnd.Float64()*2 - 1)
+	return time.Duration(d)
+}
+
+// connection keeps state of the device connection and its listeners
+type connection struct {
+	mu        sync.Mutex
+	state     connectionState
+	listeners []func(connectionEvent)
+	backoff   ReconnectOptions
+	rnd       *rand.Rand
+}
+
+// watchConnection registers fn to be called on every connection state transition
+func (d *device) watchConnection(fn func(connectionEvent)) {
+	d.conn.mu.Lock()
+	defer d.conn.mu.Unlock()
+	d.conn.listeners = append(d.conn.listeners, fn)
+}
+
+func (d *device) connectionState() connectionState {
+	d.conn.mu.Lock()
+	defer d.conn.mu.Unlock()
+	return d.conn.state
+}
+
+// setConnectionState changes the state and notifies listeners
+func (d *device) setConnectionState(state connectionState, err error) {
+	d.conn.mu.Lock()
+	ev := connectionEvent{
+		Device: d.name,
+		From:   d.conn.state,
+		To:     state,
+		Err:    err,
+	}
+	d.conn.state = state
+	listeners := append([]func(connectionEvent){}, d.conn.listeners...)
+	d.conn.mu.Unlock()
+
+	if ev.From == ev.To {
+		return
+	}
+
+	d.log.WithError(err).Debugf("connection %s -> %s", ev.From, ev.To)
+	for _, fn := range listeners {
+		fn(ev)
+	}
+}
+
+// supervise keeps the device connected until ctx is done. It pings the connected device,
+// and after failed pings it reconnects with exponential backoff.
+func (d *device) supervise(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer d.setConnectionState(stateStopped, nil)
+	defer d.closeClient()
+
+	attempt := 0
+	for ctx.Err() == nil {
+		switch d.connectionState() {
+		case stateConnected:
+			err := d.ping(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			d.closeClient()
+			attempt = 0
+			d.setConnectionState(stateBackoff, err)
+
+		case stateBackoff:
+			delay := d.conn.backoff.delay(attempt, d.conn.rnd)
+			attempt++
+			d.log.Debugf("reconnecting in %s", delay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			d.setConnectionState(stateConnecting, nil)
+
+		case stateConnecting:
+			err := d.reconnect(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				d.log.WithError(err).Error("error connecting to esphome")
+				d.closeClient()
+				d.setConnectionState(stateBackoff, err)
+			} else {
+				attempt = 0
+				d.setConnectionState(stateConnected, nil)
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+// ping pings the device until it fails to answer maxFailedPings times in a row or ctx is done
+func (d *device) ping(ctx context.Context) error {
+
+	pingTicker := time.NewTicker(pingInterval)
+	defer pingTicker.Stop()
+
+	failed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-pingTicker.C:
+		}
+
+		client := d.client()
+		if client == nil {
+			return errNotConnected
+		}
+
+		d.log.Debug("pinging esphome")
+		err := client.Ping()
+		if err == nil {
+			// device answered again after a failed ping
+			failed = 0
+			d.setOnline(true)
+			continue
+		}
+
+		d.log.WithError(err).Errorf("error pinging esphome")
+		// services are reported as faulted already after the first failed ping
+		d.setOnline(false)
+		failed++
+		if failed >= maxFailedPings {
+			return errors.New("device does not answer ping")
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package esphomehomekit
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	b := ReconnectOptions{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 2}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{5, 32 * time.Second},
+		{6, time.Minute},
+		{100, time.Minute},
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for _, tt := range tests {
+		if got := b.delay(tt.attempt, rnd); got != tt.want {
+			t.Errorf("delay(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func jitter(j float64) *float64 {
+	return &j
+}
+
+func TestReconnectDelayJitter(t *testing.T) {
+	b := ReconnectOptions{Jitter: jitter(0.5)}.withDefaults()
+	rnd := rand.New(rand.NewSource(1))
+	for attempt := 0; attempt < 20; attempt++ {
+		base := float64(b.InitialDelay) * float64(uint64(1)<<uint(attempt))
+		if base > float64(b.MaxDelay) {
+			base = float64(b.MaxDelay)
+		}
+		got := float64(b.delay(attempt, rnd))
+		if got < base*(1-*b.Jitter) || got > base*(1+*b.Jitter) {
+			t.Errorf("delay(%d) = %s, want %s ± %v%%", attempt, time.Duration(got), time.Duration(base), *b.Jitter*100)
+		}
+	}
+}
+
+func TestReconnectOptionsDefaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		b      ReconnectOptions
+		want   ReconnectOptions
+		jitter float64
+	}{
+		{"not set", ReconnectOptions{}, defaultBackoff, defaultJitter},
+		{"invalid", ReconnectOptions{Multiplier: 0.5, Jitter: jitter(2)}, defaultBackoff, defaultJitter},
+		{"set", ReconnectOptions{InitialDelay: time.Millisecond, MaxDelay: time.Second, Multiplier: 3, Jitter: jitter(0.1)},
+			ReconnectOptions{InitialDelay: time.Millisecond, MaxDelay: time.Second, Multiplier: 3}, 0.1},
+		{"jitter off", ReconnectOptions{Jitter: jitter(0)}, defaultBackoff, 0},
+	}
+	for _, tt := range tests {
+		got := tt.b.withDefaults()
+		if got.jitter() != tt.jitter {
+			t.Errorf("%s: jitter = %v, want %v", tt.name, got.jitter(), tt.jitter)
+		}
+		got.Jitter = nil
+		if got != tt.want {
+			t.Errorf("%s: withDefaults() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
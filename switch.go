@@ -0,0 +1,90 @@
+package esphomehomekit
+
+import (
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+func (d *device) createSwichService(e *Entity) (sv *service.S, err error) {
+
+	switch d.entityConfig(e).Type {
+	case "outlet":
+		k := service.NewOutlet()
+		k.OutletInUse.SetValue(true)
+		return d.createOnOffService(e, k.S, k.On)
+	case "fan":
+		k := service.NewFan()
+		return d.createOnOffService(e, k.S, k.On)
+	case "valve":
+		return d.createValveService(e)
+	}
+
+	k := service.NewSwitch()
+	// k.On.Description = e.Name
+	return d.createOnOffService(e, k.S, k.On)
+}
+
+// createOnOffService maps switch state to the On characteristic of the service
+func (d *device) createOnOffService(e *Entity, k *service.S, on *characteristic.On) (sv *service.S, err error) {
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.SwitchStateResponse)
+		if ok {
+			on.SetValue(msg.State)
+		} else {
+			d.log.Errorf("unexpected state for switch : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	on.OnSetRemoteValue(func(v bool) error {
+		return d.Send(&api.SwitchCommandRequest{
+			Key:   e.Key,
+			State: v,
+		})
+	})
+	sv = k
+	return
+}
+
+func (d *device) createValveService(e *Entity) (sv *service.S, err error) {
+
+	k := service.NewValve()
+	k.ValveType.SetValue(characteristic.ValveTypeGenericValve)
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.SwitchStateResponse)
+		if ok {
+			if msg.State {
+				k.Active.SetValue(characteristic.ActiveActive)
+				k.InUse.SetValue(characteristic.InUseInUse)
+			} else {
+				k.Active.SetValue(characteristic.ActiveInactive)
+				k.InUse.SetValue(characteristic.InUseNotInUse)
+			}
+		} else {
+			d.log.Errorf("unexpected state for switch : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	k.Active.OnSetRemoteValue(func(v int) error {
+		return d.Send(&api.SwitchCommandRequest{
+			Key:   e.Key,
+			State: v == characteristic.ActiveActive,
+		})
+	})
+	sv = k.S
+	return
+}
@@ -0,0 +1,119 @@
+package esphomehomekit
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/mycontroller-org/esphome_api/pkg/api"
+)
+
+// custom service and characteristic for text sensors (visible in third party apps, like Eve)
+const (
+	typeTextService = "4A0E6F2B-6C4B-4E1A-9E62-2C2A5B5E0010"
+	typeTextValue   = "4A0E6F2B-6C4B-4E1A-9E62-2C2A5B5E0011"
+)
+
+// textRule decides if text sensor value turns the derived binary sensor on
+type textRule func(value string) bool
+
+// textSensorRule returns rule configured for the entity, nil if there is none
+func textSensorRule(cfg EntityOptions) (textRule, error) {
+	if cfg.Match != "" {
+		re, err := regexp.Compile(cfg.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match expression %q: %w", cfg.Match, err)
+		}
+		return re.MatchString, nil
+	}
+	if cfg.Equals != "" {
+		return func(value string) bool {
+			return value == cfg.Equals
+		}, nil
+	}
+	return nil, nil
+}
+
+func (d *device) createTextSensorService(e *Entity) (sv *service.S, err error) {
+
+	rule, err := textSensorRule(d.entityConfig(e))
+	if err != nil {
+		return nil, fmt.Errorf("text sensor %s: %w", e.ID, err)
+	}
+
+	if rule != nil {
+		return d.createTextRuleService(e, rule)
+	}
+	return d.createTextCustomService(e)
+}
+
+// createTextRuleService publishes text sensor as binary sensor that is on when the rule matches
+func (d *device) createTextRuleService(e *Entity, rule textRule) (sv *service.S, err error) {
+
+	// binary sensor services are driven by a derived entity
+	derived := &Entity{
+		Key:  e.Key,
+		ID:   e.ID,
+		Name: e.Name,
+		Type: EntityTypeBinarySensor,
+		Info: &api.ListEntitiesBinarySensorResponse{
+			ObjectId: e.ID,
+			Key:      e.Key,
+			Name:     e.Name,
+		},
+	}
+
+	sv, err = d.createBinarySensorService(derived)
+	if err != nil {
+		return
+	}
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.TextSensorStateResponse)
+		if ok {
+			derived.update(&api.BinarySensorStateResponse{
+				Key:          msg.Key,
+				State:        !msg.MissingState && rule(msg.State),
+				MissingState: msg.MissingState,
+			})
+		} else {
+			d.log.Errorf("unexpected state for text sensor : %+v", newState)
+		}
+	})
+
+	return
+}
+
+// createTextCustomService publishes text sensor value as custom string characteristic
+func (d *device) createTextCustomService(e *Entity) (sv *service.S, err error) {
+
+	k := service.New(typeTextService)
+
+	name := characteristic.NewName()
+	name.SetValue(e.Name)
+	k.AddC(name.C)
+
+	value := characteristic.NewString(typeTextValue)
+	value.Format = characteristic.FormatString
+	value.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionEvents}
+	value.Description = e.Name
+	value.SetValue("")
+	k.AddC(value.C)
+
+	// esphome -> homekit
+	e.SetOnUpdate(func(newState interface{}) {
+		msg, ok := newState.(*api.TextSensorStateResponse)
+		if ok {
+			value.SetValue(msg.State)
+		} else {
+			d.log.Errorf("unexpected state for text sensor : %+v", newState)
+		}
+	})
+
+	// homekit -> esphome
+	// nothing here, as homekit can not change sensor state
+	sv = k
+	return
+}